@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Versioned JSON API for scripts and other non-browser clients. All
+// endpoints live below API_PREFIX and respond with JSON, including
+// errors.
+
+// Path all API endpoints live under.
+const API_PREFIX = "/api/v1"
+
+// Number of files per page if the client does not ask for a specific
+// page size.
+const API_DEFAULT_PER_PAGE = 50
+
+// Maximum number of files per page a client may ask for.
+const API_MAX_PER_PAGE = 1000
+
+// File as reported by the API.
+type ApiFile struct {
+	Id            string     `json:"id"`
+	Name          string     `json:"name"`
+	Size          int64      `json:"size"`
+	UploadedOnUTC time.Time  `json:"uploaded_on_utc"`
+	ExpiresOnUTC  *time.Time `json:"expires_on_utc"`
+	ContentType   string     `json:"content_type"`
+	MaxDownloads  *int       `json:"max_downloads"`
+	Downloads     int        `json:"downloads"`
+	HasPassword   bool       `json:"has_password"`
+	Owner         string     `json:"owner"`
+	Sha256        *string    `json:"sha256"`
+	Url           string     `json:"url"`
+	ShortUrl      *string    `json:"short_url"`
+	ThumbnailUrl  *string    `json:"thumbnail_url"`
+	Collections   []string   `json:"collections"`
+	Path          *string    `json:"path"`
+}
+
+// A page of files as reported by the API.
+type ApiFileList struct {
+	Files      []*ApiFile `json:"files"`
+	Page       int        `json:"page"`
+	PerPage    int        `json:"per_page"`
+	Total      int        `json:"total"`
+	Sort       string     `json:"sort"`
+	Order      string     `json:"order"`
+	Category   *string    `json:"category"`
+	Collection *string    `json:"collection"`
+	Query      *string    `json:"q"`
+}
+
+// Outcome of uploading one of multiple files as reported by the API.
+type ApiUploadResult struct {
+	Filename string   `json:"filename"`
+	File     *ApiFile `json:"file"`
+	Error    *string  `json:"error"`
+}
+
+// Outcome of uploading multiple files as reported by the API.
+type ApiUploadList struct {
+	Files []*ApiUploadResult `json:"files"`
+}
+
+// Collection as reported by the API.
+type ApiCollection struct {
+	Name         string    `json:"name"`
+	Owner        string    `json:"owner"`
+	CreatedOnUTC time.Time `json:"created_on_utc"`
+	Url          string    `json:"url"`
+	ShareUrl     *string   `json:"share_url"`
+}
+
+// Storage usage as reported by the API.
+type ApiUsage struct {
+	Files        int   `json:"files"`
+	LogicalSize  int64 `json:"logical_size"`
+	PhysicalSize int64 `json:"physical_size"`
+}
+
+// Errors as reported by the API.
+type ApiError struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"status_text"`
+	Message    string `json:"message"`
+}
+
+// Register all API endpoints with router.
+func RegisterApi(router *mux.Router) {
+	api := router.PathPrefix(API_PREFIX).Subrouter()
+
+	api.HandleFunc("/files", GetApiFiles).Methods("GET")
+	api.HandleFunc("/files", PostApiFiles).Methods("POST")
+	api.HandleFunc("/files/{file_id}", GetApiFile).Methods("GET")
+	api.HandleFunc("/files/{file_id}", DeleteApiFile).Methods("DELETE")
+	api.HandleFunc("/collections", GetApiCollections).Methods("GET")
+	api.HandleFunc("/usage", GetApiUsage).Methods("GET")
+
+	api.NotFoundHandler = ApiErrorHandler(http.StatusNotFound, "no such endpoint")
+	api.MethodNotAllowedHandler = ApiErrorHandler(http.StatusMethodNotAllowed, "")
+}
+
+// GET /api/v1/files
+func GetApiFiles(w http.ResponseWriter, r *http.Request) {
+	if permitted := ApiErrorIfNotPermitted(w, r, SCOPE_LIST); !permitted {
+		return
+	}
+
+	listing, err := ParseListing(r, API_DEFAULT_PER_PAGE, API_MAX_PER_PAGE)
+	if err != nil {
+		DoApiError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	fs, err := listing.Query()
+	if err != nil {
+		DoApiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	list := ApiFileList{
+		Files:   []*ApiFile{},
+		Page:    listing.Page,
+		PerPage: listing.PerPage,
+		Total:   listing.Total,
+		Sort:    listing.Sort,
+		Order:   "asc",
+	}
+
+	if listing.Descending {
+		list.Order = "desc"
+	}
+
+	if listing.Category != "" {
+		list.Category = &listing.Category
+	}
+
+	if listing.Collection != "" {
+		list.Collection = &listing.Collection
+	}
+
+	if listing.Search != "" {
+		list.Query = &listing.Search
+	}
+
+	for _, f := range fs {
+		list.Files = append(list.Files, apiFileFrom(r, f))
+	}
+
+	WriteJson(w, http.StatusOK, &list)
+}
+
+// POST /api/v1/files
+func PostApiFiles(w http.ResponseWriter, r *http.Request) {
+	if permitted := ApiErrorIfNotPermitted(w, r, SCOPE_UPLOAD); !permitted {
+		return
+	}
+
+	results, status, err := ReceiveUploads(w, r)
+	if err != nil {
+		DoApiError(w, r, status, err.Error())
+		return
+	}
+
+	// a single file is reported like it always was; for multiple
+	// files, we report what happened to each of them
+
+	if len(results) == 1 {
+		if err := results[0].Err; err != nil {
+			DoApiError(w, r, results[0].Status, err.Error())
+			return
+		}
+
+		fm := results[0].File
+
+		w.Header().Set("Location", path.Join(API_PREFIX, "files", fm.Id))
+		WriteJson(w, http.StatusCreated, apiFileFrom(r, fm))
+		return
+	}
+
+	list := ApiUploadList{Files: []*ApiUploadResult{}}
+	status = http.StatusCreated
+
+	for _, result := range results {
+		ar := ApiUploadResult{Filename: result.Filename}
+
+		if result.Err != nil {
+			message := result.Err.Error()
+			ar.Error = &message
+			status = http.StatusMultiStatus
+		} else {
+			ar.File = apiFileFrom(r, result.File)
+		}
+
+		list.Files = append(list.Files, &ar)
+	}
+
+	WriteJson(w, status, &list)
+}
+
+// GET /api/v1/files/{file_id}
+func GetApiFile(w http.ResponseWriter, r *http.Request) {
+	if permitted := ApiErrorIfNotPermitted(w, r, SCOPE_LIST); !permitted {
+		return
+	}
+
+	id := mux.Vars(r)["file_id"]
+
+	lease := LockFileRead(id)
+	defer lease.Unlock()
+
+	fm, err := LoadFile(id)
+	if err != nil {
+		DoApiError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	WriteJson(w, http.StatusOK, apiFileFrom(r, fm))
+}
+
+// DELETE /api/v1/files/{file_id}
+func DeleteApiFile(w http.ResponseWriter, r *http.Request) {
+	if permitted := ApiErrorIfNotPermitted(w, r, SCOPE_DELETE); !permitted {
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoApiError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	id := mux.Vars(r)["file_id"]
+
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	fm, err := LoadFile(id)
+	if err != nil {
+		DoApiError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	if !user.MayDelete(fm) {
+		DoApiError(w, r, http.StatusForbidden, "only the owner of a file may delete it")
+		return
+	}
+
+	if err := DeleteFile(id); err != nil {
+		DoApiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/collections
+func GetApiCollections(w http.ResponseWriter, r *http.Request) {
+	if permitted := ApiErrorIfNotPermitted(w, r, SCOPE_LIST); !permitted {
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	collections, err := Collections()
+	if err != nil {
+		DoApiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	base := baseUrlFor(r)
+	acs := []*ApiCollection{}
+
+	for _, c := range collections {
+		ac := ApiCollection{
+			Name:         c.Name,
+			Owner:        c.Owner,
+			CreatedOnUTC: c.CreatedOnUTC,
+			Url:          base + c.Url(),
+		}
+
+		if c.IsShared() {
+			shareUrl := base + c.SharePath()
+			ac.ShareUrl = &shareUrl
+		}
+
+		acs = append(acs, &ac)
+	}
+
+	WriteJson(w, http.StatusOK, acs)
+}
+
+// GET /api/v1/usage
+func GetApiUsage(w http.ResponseWriter, r *http.Request) {
+	if permitted := ApiErrorIfNotPermitted(w, r, SCOPE_LIST); !permitted {
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	usage, err := GetFileIndex().Usage()
+	if err != nil {
+		DoApiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	au := ApiUsage{
+		Files:        usage.Files,
+		LogicalSize:  usage.LogicalSize,
+		PhysicalSize: usage.PhysicalSize,
+	}
+
+	WriteJson(w, http.StatusOK, &au)
+}
+
+// Like ErrorIfNotPermitted, but reports errors as JSON.
+func ApiErrorIfNotPermitted(w http.ResponseWriter, r *http.Request, scope string) (permitted bool) {
+	status, message, permitted := checkPermitted(r, scope)
+
+	if !permitted {
+		DoApiError(w, r, status, message)
+	}
+
+	return permitted
+}
+
+func DoApiError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	ApiErrorHandler(status, message).ServeHTTP(w, r)
+}
+
+// Return an error handler for status that reports errors as JSON.
+func ApiErrorHandler(status int, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := ApiError{
+			Status:     status,
+			StatusText: http.StatusText(status),
+			Message:    message,
+		}
+
+		WriteJson(w, status, map[string]any{"error": &e})
+	}
+}
+
+// Write v encoded as JSON to w.
+func WriteJson(w http.ResponseWriter, status int, v any) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if _, err := w.Write(bs); err != nil {
+		log.Printf("writing JSON response failed: %v", err)
+	}
+}
+
+// Convert fm to its API representation. URLs are made absolute based
+// on the configured HostName.
+func apiFileFrom(r *http.Request, fm *File) *ApiFile {
+	base := baseUrlFor(r)
+
+	af := ApiFile{
+		Id:            fm.Id,
+		Name:          fm.Name,
+		Size:          fm.Size,
+		UploadedOnUTC: fm.UploadedOnUTC,
+		ExpiresOnUTC:  fm.ExpiresOnUTC,
+		ContentType:   fm.ContentType,
+		MaxDownloads:  fm.MaxDownloads,
+		Downloads:     fm.Downloads,
+		HasPassword:   fm.HasPassword(),
+		Owner:         fm.Owner,
+		Url:           base + fm.Url(),
+		Collections:   fm.Collections,
+	}
+
+	if af.Collections == nil {
+		af.Collections = []string{}
+	}
+
+	if fm.Path != "" {
+		af.Path = &fm.Path
+	}
+
+	if checksum, ok := fm.Checksum(); ok {
+		af.Sha256 = &checksum
+	}
+
+	if fm.HasShortUrl() {
+		shortUrl := base + path.Join("/f", *fm.ShortId)
+		af.ShortUrl = &shortUrl
+	}
+
+	if fm.HasThumbnail() {
+		thumbnailUrl := base + fm.ThumbnailUrl()
+		af.ThumbnailUrl = &thumbnailUrl
+	}
+
+	return &af
+}
+
+// Return scheme and host this instance is reachable under, for example
+// "https://files.example.com". We assume that requests that were
+// forwarded by a proxy with X-Forwarded-Proto set were originally sent
+// with that scheme.
+func baseUrlFor(r *http.Request) string {
+	scheme := "http"
+
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	u := url.URL{Scheme: scheme, Host: GetConfig().HostName}
+	return u.String()
+}
+
+// Return integer query parameter key of r. If it is missing, return
+// fallback.
+func queryInt(r *http.Request, key string, fallback int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Downloading many files at once as one archive. Archives are written
+// to the client while we read the files, so they are never stored,
+// neither in memory nor on disk.
+
+// Archive formats clients can ask for.
+const (
+	ARCHIVE_ZIP    = "zip"
+	ARCHIVE_TAR_GZ = "tar.gz"
+)
+
+// Maximum number of files a client may select for one archive.
+// Collections are not limited.
+const MAX_ARCHIVE_FILES = 1000
+
+// Writes files into an archive one after the other.
+type archiveWriter interface {
+	// Start entry name for file f. Write the contents of f to the
+	// returned writer before starting the next entry.
+	Create(name string, f *File) (io.Writer, error)
+
+	// Finish the archive. Does not close the underlying writer.
+	Close() error
+}
+
+// GET, POST /archive
+func DoArchive(w http.ResponseWriter, r *http.Request) {
+	format, err := parseArchiveFormat(r.FormValue("format"))
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// ids come from checkboxes, so the same id might be in there
+	// twice if the form was manipulated
+
+	var ids []string
+	seen := make(map[string]bool)
+
+	for _, id := range r.Form["id"] {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		DoError(w, r, http.StatusBadRequest, "no files selected")
+		return
+	}
+
+	if len(ids) > MAX_ARCHIVE_FILES {
+		DoError(w, r, http.StatusBadRequest, fmt.Sprintf("cannot download more than %v files at once", MAX_ARCHIVE_FILES))
+		return
+	}
+
+	// the client picked these files, so instead of leaving some
+	// out, we complain if we cannot send all of them
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	var files []*File
+
+	for _, id := range ids {
+		fm, err := LoadFile(id)
+		if err != nil {
+			DoError(w, r, StatusForLoadError(err), err.Error())
+			return
+		}
+
+		if status, err := checkArchivable(r, fm); err != nil {
+			DoError(w, r, status, err.Error())
+			return
+		}
+
+		files = append(files, fm)
+	}
+
+	lease.Unlock()
+
+	WriteArchive(w, "files", format, files)
+}
+
+// GET /c/{collection}/archive
+func GetCollectionArchive(w http.ResponseWriter, r *http.Request) {
+	if authed := ErrorIfNotAuthorized(w, r); !authed {
+		return
+	}
+
+	format, err := parseArchiveFormat(r.FormValue("format"))
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	collection, err := LoadCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	files, err := archivableFilesIn(r, collection)
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	WriteArchive(w, collection.Name, format, files)
+}
+
+// GET /s/{share_token}/archive
+func GetSharedCollectionArchive(w http.ResponseWriter, r *http.Request) {
+	format, err := parseArchiveFormat(r.FormValue("format"))
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	collection, err := LoadSharedCollection(mux.Vars(r)["share_token"])
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	files, err := archivableFilesIn(r, collection)
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	WriteArchive(w, collection.Name, format, files)
+}
+
+// Stream an archive with files in given format to w. The archive is
+// offered for download as name plus the extension for format.
+//
+// Do not call this function while holding any lock. We lock each
+// file while we copy it into the archive.
+func WriteArchive(w http.ResponseWriter, name, format string, files []*File) {
+	filename := name + "." + format
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Cache-Control", "no-store")
+
+	var aw archiveWriter
+
+	switch format {
+	case ARCHIVE_TAR_GZ:
+		w.Header().Set("Content-Type", "application/gzip")
+		aw = newTarGzArchive(w)
+	default:
+		w.Header().Set("Content-Type", "application/zip")
+		aw = newZipArchive(w)
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// once we started sending, we cannot report errors anymore; all we
+	// can do is stop, leaving the client with an incomplete archive
+
+	names := make(entryNames)
+
+	for _, f := range files {
+		if err := addToArchive(aw, names, f); err != nil {
+			log.Printf(`writing archive filename="%v" failed: %v`, filename, err)
+			return
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		log.Printf(`writing archive filename="%v" failed: %v`, filename, err)
+	}
+}
+
+// Write the contents of f into aw. Files deleted since we listed them
+// are skipped.
+func addToArchive(aw archiveWriter, names entryNames, f *File) error {
+	lease := LockFileRead(f.Id)
+	defer lease.Unlock()
+
+	fm, err := LoadFile(f.Id)
+	if err != nil {
+		log.Printf(`not archiving id="%v": %v`, f.Id, err)
+		return nil
+	}
+
+	blob, err := OpenFile(fm)
+	if err != nil {
+		return err
+	}
+
+	defer blob.Close()
+
+	dst, err := aw.Create(names.unique(fm.DisplayPath()), fm)
+	if err != nil {
+		return err
+	}
+
+	if n, err := io.Copy(dst, blob); err != nil {
+		return errors.Wrapf(err, `cannot archive id="%v"`, fm.Id)
+	} else if n != fm.Size {
+		return fmt.Errorf(`contents of id="%v" have %v bytes, expected %v`, fm.Id, n, fm.Size)
+	}
+
+	return nil
+}
+
+// Return the files in collection we may put into an archive for r,
+// sorted by name. Files we may not send are left out.
+//
+// Only call this function if you are holding the global read lock.
+func archivableFilesIn(r *http.Request, collection *Collection) ([]*File, error) {
+	files, _, err := GetFileIndex().Query(&FileQuery{Collection: collection.Name, Sort: SORT_NAME})
+	if err != nil {
+		return nil, err
+	}
+
+	var archivable []*File
+
+	for _, f := range files {
+		if _, err := checkArchivable(r, f); err == nil {
+			archivable = append(archivable, f)
+		}
+	}
+
+	return archivable, nil
+}
+
+// Check whether we may send file fm to r as part of an archive. If not,
+// return the status code to report and an error that explains why.
+// Files with a download limit are never archived, as we would have to
+// count each of them as downloaded before we know the client got them.
+func checkArchivable(r *http.Request, fm *File) (int, error) {
+	switch {
+	case fm.Expired():
+		return http.StatusGone, fmt.Errorf(`filename="%v" expired`, fm.Name)
+	case fm.Exhausted():
+		return http.StatusGone, fmt.Errorf(`filename="%v" was downloaded too often`, fm.Name)
+	case fm.HasDownloadLimit():
+		return http.StatusForbidden, fmt.Errorf(`filename="%v" has a download limit, download it on its own`, fm.Name)
+	case !IsUnlocked(r, fm):
+		return http.StatusForbidden, fmt.Errorf(`filename="%v" is password protected, unlock it first`, fm.Name)
+	default:
+		return http.StatusOK, nil
+	}
+}
+
+// Parse the archive format a client asked for. Empty means ZIP.
+func parseArchiveFormat(value string) (string, error) {
+	switch value {
+	case "", ARCHIVE_ZIP:
+		return ARCHIVE_ZIP, nil
+	case ARCHIVE_TAR_GZ:
+		return ARCHIVE_TAR_GZ, nil
+	default:
+		return "", fmt.Errorf(`bad format="%v"`, value)
+	}
+}
+
+// Names of the entries in an archive so far, in lower case so names
+// that only differ in case do not clash on case-insensitive file
+// systems.
+type entryNames map[string]bool
+
+// Return filename as the name of a new entry. Files uploaded as part
+// of a folder keep their path. If an entry with that name exists
+// already, a number is added, e.g. "build (2).log".
+func (en entryNames) unique(filename string) string {
+	// entries are extracted relative to the current directory, so
+	// names must not climb out of it
+
+	if name, relPath := parseUploadPath(filename); relPath != "" {
+		filename = relPath
+	} else {
+		filename = name
+	}
+
+	filename = strings.TrimLeft(filename, ".")
+
+	if filename == "" {
+		filename = "file"
+	}
+
+	ext := path.Ext(filename)
+	stem := strings.TrimSuffix(filename, ext)
+
+	name := filename
+
+	for i := 2; en[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%v (%v)%v", stem, i, ext)
+	}
+
+	en[strings.ToLower(name)] = true
+	return name
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func newZipArchive(w io.Writer) *zipArchive {
+	return &zipArchive{zw: zip.NewWriter(w)}
+}
+
+func (za *zipArchive) Create(name string, f *File) (io.Writer, error) {
+	header := zip.FileHeader{
+		Name:     name,
+		Modified: f.UploadedOnUTC,
+		Method:   zip.Deflate,
+	}
+
+	// compressing images and archives again only costs time
+
+	if category := f.Category(); category == CATEGORY_IMAGES || category == CATEGORY_ARCHIVES {
+		header.Method = zip.Store
+	}
+
+	header.SetMode(0644)
+
+	return za.zw.CreateHeader(&header)
+}
+
+func (za *zipArchive) Close() error {
+	return za.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzArchive(w io.Writer) *tarGzArchive {
+	gz := gzip.NewWriter(w)
+	return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (ta *tarGzArchive) Create(name string, f *File) (io.Writer, error) {
+	header := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     f.Size,
+		Mode:     0644,
+		ModTime:  f.UploadedOnUTC,
+		Format:   tar.FormatPAX,
+	}
+
+	if err := ta.tw.WriteHeader(&header); err != nil {
+		return nil, err
+	}
+
+	return ta.tw, nil
+}
+
+func (ta *tarGzArchive) Close() error {
+	if err := ta.tw.Close(); err != nil {
+		return err
+	}
+
+	return ta.gz.Close()
+}
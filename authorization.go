@@ -6,6 +6,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -15,6 +16,14 @@ const (
 
 	// How long to keep a user logged in after log in.
 	LOGIN_DURATION = 14 * 24 * time.Hour
+
+	// Prefix of keys used to identify cookies of type UnlockedCookie.
+	// The full key also contains the id of the unlocked file.
+	UNLOCKED_COOKIE_PREFIX = "UnlockedCookie-"
+
+	// How long a password protected file stays unlocked after the
+	// visitor entered the correct password.
+	UNLOCK_DURATION = 24 * time.Hour
 )
 
 var (
@@ -38,6 +47,25 @@ type AuthorizedCookie struct {
 	// clear the cookie to avoid annoying error messages when
 	// parsing the cookie.
 	LoggedIn bool
+
+	// Name of the user who logged in. Empty for users who logged
+	// in with one of the legacy Config.PassHashes.
+	Username string
+}
+
+// The cookie we set if a visitor entered the correct password for a
+// password protected file. Each cookie only unlocks a single file.
+type UnlockedCookie struct {
+	// The id of the file this cookie unlocks.
+	FileId string
+
+	// When the visitor entered the password.
+	UnlockedOnUTC time.Time
+}
+
+// Return the expiry date for the given cookie.
+func (uc *UnlockedCookie) ExpiryDate() time.Time {
+	return uc.UnlockedOnUTC.Add(UNLOCK_DURATION)
 }
 
 // Return the expiry date for the given cookie. This function ignores the value
@@ -69,26 +97,144 @@ func init() {
 // Return whether request r is authenticated to upload, delete and
 // list files.
 func IsAuthorized(r *http.Request) (authorized bool, err error) {
+	ac, err := authorizedCookieOf(r)
+	if err != nil {
+		return false, err
+	}
+
+	if !ac.Authorized() {
+		return false, nil
+	}
+
+	// users removed from the config file should not be able to
+	// continue with their old cookie
+
+	if _, err := FindUser(ac.Username); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Return the decoded log in cookie of r.
+func authorizedCookieOf(r *http.Request) (*AuthorizedCookie, error) {
 	cookie, err := r.Cookie(AUTHORIZED_COOKIE)
 	if err != nil {
-		return false, errors.Wrap(err, "could not read cookie from request")
+		return nil, errors.Wrap(err, "could not read cookie from request")
 	}
 
 	var ac AuthorizedCookie
 
 	encoder := securecookie.New(HashKey, BlockKey)
 	if err := encoder.Decode(AUTHORIZED_COOKIE, cookie.Value, &ac); err != nil {
-		return false, errors.Wrap(err, "could not decode cookie")
+		return nil, errors.Wrap(err, "could not decode cookie")
 	}
 
-	return ac.Authorized(), nil
+	return &ac, nil
 }
 
-// Set a cookie on w that indicates that this user is logged in.
-func SetAuthorized(w http.ResponseWriter) error {
+// Return whether request r may access password protected file fm.
+// Files without a password are always accessible. Otherwise, the
+// request needs to be permitted to list files or carry a cookie set
+// by SetUnlocked for fm.
+func IsUnlocked(r *http.Request, fm *File) bool {
+	if !fm.HasPassword() {
+		return true
+	}
+
+	if permitted, err := IsPermitted(r, SCOPE_LIST); err == nil && permitted {
+		return true
+	}
+
+	name := UNLOCKED_COOKIE_PREFIX + fm.Id
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+
+	var uc UnlockedCookie
+
+	encoder := securecookie.New(HashKey, BlockKey)
+	if err := encoder.Decode(name, cookie.Value, &uc); err != nil {
+		return false
+	}
+
+	expired := time.Now().UTC().After(uc.ExpiryDate())
+	return uc.FileId == fm.Id && !expired
+}
+
+// Set a cookie on w that unlocks password protected file fm.
+func SetUnlocked(w http.ResponseWriter, fm *File) error {
+	uc := UnlockedCookie{
+		FileId:        fm.Id,
+		UnlockedOnUTC: time.Now().UTC(),
+	}
+
+	name := UNLOCKED_COOKIE_PREFIX + fm.Id
+
+	encoder := securecookie.New(HashKey, BlockKey)
+	value, err := encoder.Encode(name, &uc)
+	if err != nil {
+		return errors.Wrap(err, "could not encode cookie")
+	}
+
+	cookie := &http.Cookie{
+		Expires:  uc.ExpiryDate(),
+		HttpOnly: true,
+		Name:     name,
+		Path:     "/",
+		Secure:   false,
+		Value:    value,
+	}
+
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// Return whether request r is permitted to do what scope describes.
+// Requests with a valid log in cookie may do everything. Requests with
+// an API token in the Authorization header may only do what the token
+// was created for.
+func IsPermitted(r *http.Request, scope string) (permitted bool, err error) {
+	token, ok := BearerToken(r)
+	if !ok {
+		return IsAuthorized(r)
+	}
+
+	t, err := LookupToken(token)
+	if err != nil {
+		return false, errors.Wrap(err, "could not authorize token")
+	}
+
+	// tokens of users removed from the config file stop working
+
+	if _, err := FindUser(t.Owner); err != nil {
+		return false, errors.Wrap(err, "could not authorize token")
+	}
+
+	return t.HasScope(scope), nil
+}
+
+// Return the token of an "Authorization: Bearer <token>" header if r
+// has one.
+func BearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	prefix := "Bearer "
+
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// Set a cookie on w that indicates that user is logged in.
+func SetAuthorized(w http.ResponseWriter, user *User) error {
 	ac := AuthorizedCookie{
 		AuthorizedOnUTC: time.Now().UTC(),
 		LoggedIn:        true,
+		Username:        user.Name,
 	}
 
 	return setCookie(w, &ac)
@@ -104,8 +250,8 @@ func SetUnauthorized(w http.ResponseWriter) error {
 	return setCookie(w, &ac)
 }
 
-// Return whether pass is a valid password set up in the configuration
-// file.
+// Return whether pass is one of the legacy passwords set up in
+// Config.PassHashes.
 func IsValidPassword(pass string) bool {
 	pb := []byte(pass)
 
@@ -120,6 +266,17 @@ func IsValidPassword(pass string) bool {
 	return false
 }
 
+// Return a bcrypt hash of pass suitable for storing in config files
+// and metadata.
+func HashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "could not hash password")
+	}
+
+	return string(hash), nil
+}
+
 func setCookie(w http.ResponseWriter, ac *AuthorizedCookie) error {
 	encoder := securecookie.New(HashKey, BlockKey)
 	value, err := encoder.Encode(AUTHORIZED_COOKIE, &ac)
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/pkg/errors"
+)
+
+// Name of the file inside UploadsDirectory that lists all collections.
+const COLLECTIONS_FILE = ".collections.json"
+
+// Number of random characters in the token of a public collection link.
+const SHARE_TOKEN_LENGTH = 32
+
+// A named group of files. Files can be in any number of collections,
+// see File.Collections.
+type Collection struct {
+	// Name of this collection as chosen by the user, see
+	// ParseCollectionName.
+	Name string
+
+	// Name of the user who created this collection.
+	Owner string
+
+	// When this collection was created.
+	CreatedOnUTC time.Time
+
+	// Token of the public link that lists the files in this collection.
+	// Empty if the collection is not shared.
+	ShareToken string
+}
+
+// Return the absolute path of the page that lists the files in this
+// collection.
+func (c *Collection) Url() string {
+	return "/c/" + c.Name
+}
+
+// Return the absolute path under which all files in this collection
+// can be downloaded as one archive.
+func (c *Collection) ArchivePath() string {
+	return c.Url() + "/archive"
+}
+
+// Return whether this collection can be viewed by everybody with
+// the public link.
+func (c *Collection) IsShared() bool {
+	return c.ShareToken != ""
+}
+
+// Return the absolute path of the public page of this collection.
+// Only valid if the collection is shared.
+func (c *Collection) SharePath() string {
+	return "/s/" + c.ShareToken
+}
+
+// Return the absolute path under which everybody can download all
+// files in this collection as one archive. Only valid if the collection
+// is shared.
+func (c *Collection) ShareArchivePath() string {
+	return c.SharePath() + "/archive"
+}
+
+// Return the public link of this collection. Only valid if the
+// collection is shared.
+func (c *Collection) ShareUrl() string {
+	return path.Join(GetConfig().HostName, "s", c.ShareToken)
+}
+
+// Return creation date as human-readable string.
+func (c *Collection) HumanCreatedOn() string {
+	return c.CreatedOnUTC.Format("2006-01-02 15:04")
+}
+
+// Return whether this file is in the collection with given name.
+func (f *File) InCollection(name string) bool {
+	for _, c := range f.Collections {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return all collections, sorted by name.
+//
+// Only call this function if you are holding the global read lock.
+func Collections() ([]*Collection, error) {
+	return loadCollections()
+}
+
+// Return the collection with given name.
+//
+// Only call this function if you are holding the global read lock.
+func LoadCollection(name string) (*Collection, error) {
+	if _, err := ParseCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	cs, err := loadCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf(`no collection="%v"`, name)
+}
+
+// Return the shared collection with given share token.
+//
+// Only call this function if you are holding the global read lock.
+func LoadSharedCollection(token string) (*Collection, error) {
+	if len(token) != SHARE_TOKEN_LENGTH {
+		return nil, &InvalidIdError{Kind: "shareToken", Id: token}
+	}
+
+	cs, err := loadCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		if c.IsShared() && c.ShareToken == token {
+			return c, nil
+		}
+	}
+
+	return nil, errors.New("no collection with that share token")
+}
+
+// Create a new, empty collection with given name for user owner.
+//
+// Only call this function if you are holding the global write lock.
+func CreateCollection(owner, name string) (*Collection, error) {
+	if _, err := ParseCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	cs, err := loadCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		if c.Name == name {
+			return nil, fmt.Errorf(`collection="%v" exists already`, name)
+		}
+	}
+
+	c := Collection{
+		Name:         name,
+		Owner:        owner,
+		CreatedOnUTC: time.Now().UTC(),
+	}
+
+	if err := storeCollections(append(cs, &c)); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Delete the collection with given name. The files in it are kept,
+// they are only removed from the collection.
+//
+// Only call this function if you are holding the global write lock.
+func DeleteCollection(name string) error {
+	cs, err := loadCollections()
+	if err != nil {
+		return err
+	}
+
+	var kept []*Collection
+
+	for _, c := range cs {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+
+	if len(kept) == len(cs) {
+		return fmt.Errorf(`no collection="%v"`, name)
+	}
+
+	// forget about the collection first; if updating the files
+	// fails halfway, they only refer to a collection that does
+	// not exist anymore, which we ignore
+
+	if err := storeCollections(kept); err != nil {
+		return err
+	}
+
+	files, _, err := GetFileIndex().Query(&FileQuery{Collection: name})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := RemoveFromCollection(f.Id, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create a public link for the collection with given name if share is
+// true, otherwise revoke its public link. Sharing an already shared
+// collection keeps its link. Returns the updated collection.
+//
+// Only call this function if you are holding the global write lock.
+func ShareCollection(name string, share bool) (*Collection, error) {
+	cs, err := loadCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		if c.Name != name {
+			continue
+		}
+
+		switch {
+		case share && !c.IsShared():
+			c.ShareToken = uniuri.NewLen(SHARE_TOKEN_LENGTH)
+		case !share:
+			c.ShareToken = ""
+		}
+
+		if err := storeCollections(cs); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	return nil, fmt.Errorf(`no collection="%v"`, name)
+}
+
+// Put the file with given id into the collection with given name.
+// Adding a file to a collection it is in already does nothing.
+//
+// Only call this function if you are holding the write lock of the
+// file (see LockFileWrite) or the global write lock.
+func AddToCollection(id, name string) error {
+	if _, err := LoadCollection(name); err != nil {
+		return err
+	}
+
+	meta, err := LoadFile(id)
+	if err != nil {
+		return err
+	}
+
+	if meta.InCollection(name) {
+		return nil
+	}
+
+	meta.Collections = append(meta.Collections, name)
+	sort.Strings(meta.Collections)
+
+	return UpdateFile(meta)
+}
+
+// Take the file with given id out of the collection with given name.
+// Removing a file from a collection it is not in does nothing.
+//
+// Only call this function if you are holding the write lock of the
+// file (see LockFileWrite) or the global write lock.
+func RemoveFromCollection(id, name string) error {
+	meta, err := LoadFile(id)
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+
+	for _, c := range meta.Collections {
+		if c != name {
+			kept = append(kept, c)
+		}
+	}
+
+	if len(kept) == len(meta.Collections) {
+		return nil
+	}
+
+	meta.Collections = kept
+
+	return UpdateFile(meta)
+}
+
+// Check that all names are names of existing collections.
+//
+// Only call this function if you are holding the global read lock.
+func checkCollections(names []string) error {
+	for _, name := range names {
+		if _, err := LoadCollection(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create the collections in names that do not exist yet for user
+// owner. Returns the names of the created collections.
+//
+// Only call this function if you are holding the global write lock.
+func createMissingCollections(owner string, names []string) ([]string, error) {
+	var created []string
+
+	for _, name := range names {
+		if _, err := LoadCollection(name); err == nil {
+			continue
+		}
+
+		if _, err := CreateCollection(owner, name); err != nil {
+			deleteCollections(created)
+			return nil, err
+		}
+
+		created = append(created, name)
+	}
+
+	return created, nil
+}
+
+// Delete the collections with given names, e.g. because the upload
+// they were created for failed. Errors are only logged.
+//
+// Only call this function if you are holding the global write lock.
+func deleteCollections(names []string) {
+	for _, name := range names {
+		if err := DeleteCollection(name); err != nil {
+			log.Printf(`could not delete collection="%v": %v`, name, err)
+		}
+	}
+}
+
+func collectionsPath() string {
+	return filepath.Join(GetConfig().UploadsDirectory, COLLECTIONS_FILE)
+}
+
+func loadCollections() ([]*Collection, error) {
+	bs, err := ioutil.ReadFile(collectionsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read collections file")
+	}
+
+	var cs []*Collection
+	if err := json.Unmarshal(bs, &cs); err != nil {
+		return nil, errors.Wrap(err, "cannot parse collections file")
+	}
+
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].Name < cs[j].Name
+	})
+
+	return cs, nil
+}
+
+// Replace the contents of the collections file with cs. Only call this
+// function if you are holding the global write lock.
+func storeCollections(cs []*Collection) error {
+	if cs == nil {
+		cs = []*Collection{}
+	}
+
+	bs, err := json.MarshalIndent(cs, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "cannot construct collections file")
+	}
+
+	// write to a temporary file first so readers never see a
+	// half-written collections file
+
+	path := collectionsPath()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".collections-*")
+	if err != nil {
+		return errors.Wrap(err, "cannot create collections file")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(bs); err != nil {
+		return errors.Wrap(err, "cannot write collections file")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return errors.Wrap(err, "cannot sync collections file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot write collections file")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "cannot replace collections file")
+	}
+
+	return nil
+}
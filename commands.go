@@ -0,0 +1,272 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Commands that can be run from the command line instead of running
+// the web server, e.g. "fmajor token list". Each command gets the
+// arguments following the command name.
+var commands = map[string]func(args []string) error{
+	"token": tokenCommand,
+	"key":   keyCommand,
+	"fsck":  fsckCommand,
+	"index": indexCommand,
+}
+
+// Print usage information to stderr.
+func Usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "usage: %v [-c config] [command [arguments]]\n\n", os.Args[0])
+	fmt.Fprintf(out, "Without a command, runs the web server. Available commands:\n\n")
+	fmt.Fprintf(out, "  token create -name NAME [-owner USER] [-scopes SCOPES] [-lifetime DURATION]\n")
+	fmt.Fprintf(out, "  token list\n")
+	fmt.Fprintf(out, "  token revoke ID\n")
+	fmt.Fprintf(out, "  key generate\n")
+	fmt.Fprintf(out, "  key rotate -new-key-file FILE\n")
+	fmt.Fprintf(out, "  fsck [-repair]\n")
+	fmt.Fprintf(out, "  index rebuild\n\n")
+	fmt.Fprintf(out, "Flags:\n\n")
+
+	flag.PrintDefaults()
+}
+
+// Run the command described by args, that is the command line arguments
+// after all global flags.
+func RunCommand(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		flag.Usage()
+		return fmt.Errorf(`unknown command="%v"`, args[0])
+	}
+
+	return command(args[1:])
+}
+
+// fmajor token ...
+func tokenCommand(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		return errors.New("missing token subcommand")
+	}
+
+	switch args[0] {
+	case "create":
+		return tokenCreateCommand(args[1:])
+	case "list":
+		return tokenListCommand(args[1:])
+	case "revoke":
+		return tokenRevokeCommand(args[1:])
+	default:
+		flag.Usage()
+		return fmt.Errorf(`unknown token subcommand="%v"`, args[0])
+	}
+}
+
+// fmajor token create ...
+func tokenCreateCommand(args []string) error {
+	fs := flag.NewFlagSet("token create", flag.ExitOnError)
+	name := fs.String("name", "", "name of the token")
+	owner := fs.String("owner", "", "name of the user the token acts on behalf of")
+	scopes := fs.String("scopes", strings.Join(AllScopes, ","), "comma separated list of scopes")
+	lifetime := fs.Duration("lifetime", 0, "how long the token is valid; zero for forever")
+	fs.Parse(args)
+
+	if _, err := FindUser(*owner); err != nil {
+		return err
+	}
+
+	token, meta, err := CreateToken(*owner, *name, strings.Split(*scopes, ","), *lifetime)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created token id=%v; store it now, it is not shown again:\n\n", meta.Id)
+	fmt.Println(token)
+
+	return nil
+}
+
+// fmajor token list
+func tokenListCommand(args []string) error {
+	fs := flag.NewFlagSet("token list", flag.ExitOnError)
+	fs.Parse(args)
+
+	tokens, err := Tokens()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tOWNER\tSCOPES\tCREATED\tEXPIRES")
+
+	for _, t := range tokens {
+		expires := t.HumanExpiresOn()
+		if t.Expired() {
+			expires += " (expired)"
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", t.Id, t.Name, t.Owner, t.HumanScopes(), t.HumanCreatedOn(), expires)
+	}
+
+	return tw.Flush()
+}
+
+// fmajor token revoke ID
+func tokenRevokeCommand(args []string) error {
+	fs := flag.NewFlagSet("token revoke", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one token id")
+	}
+
+	return RevokeToken(fs.Arg(0))
+}
+
+// fmajor key ...
+func keyCommand(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		return errors.New("missing key subcommand")
+	}
+
+	switch args[0] {
+	case "generate":
+		return keyGenerateCommand(args[1:])
+	case "rotate":
+		return keyRotateCommand(args[1:])
+	default:
+		flag.Usage()
+		return fmt.Errorf(`unknown key subcommand="%v"`, args[0])
+	}
+}
+
+// fmajor key generate
+func keyGenerateCommand(args []string) error {
+	fs := flag.NewFlagSet("key generate", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, err := GenerateMasterKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(key)
+	return nil
+}
+
+// fmajor key rotate -new-key-file FILE
+func keyRotateCommand(args []string) error {
+	fs := flag.NewFlagSet("key rotate", flag.ExitOnError)
+	newKeyFile := fs.String("new-key-file", "", "file containing the new key")
+	fs.Parse(args)
+
+	if *newKeyFile == "" {
+		return errors.New("missing -new-key-file")
+	}
+
+	oldKey, err := loadMasterKey(GetConfig())
+	if err != nil {
+		return err
+	}
+
+	if oldKey == nil {
+		return errors.New("no encryption key configured")
+	}
+
+	newKey, err := LoadMasterKeyFile(*newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	// blobs already sealed with newKey are skipped, so if rotating
+	// fails half way, running the command again picks up where we
+	// left off
+
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	err = GetStorage().RewrapBlobs(func(header []byte, sealing Sealing) ([]byte, error) {
+		return newKey.Rewrap(header, oldKey, sealing)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "rotated from key id=%v to key id=%v; configure the new key now\n", oldKey.Id(), newKey.Id())
+	return nil
+}
+
+// fmajor fsck [-repair]
+func fsckCommand(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair problems where possible")
+	fs.Parse(args)
+
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	checker := &Checker{Repair: *repair, Out: os.Stdout}
+
+	if err := checker.Check(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "found %v problems, repaired %v\n", checker.Problems, checker.Repaired)
+
+	if checker.Problems > checker.Repaired {
+		return errors.New("storage has problems")
+	}
+
+	return nil
+}
+
+// fmajor index ...
+func indexCommand(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		return errors.New("missing index subcommand")
+	}
+
+	switch args[0] {
+	case "rebuild":
+		return indexRebuildCommand(args[1:])
+	default:
+		flag.Usage()
+		return fmt.Errorf(`unknown index subcommand="%v"`, args[0])
+	}
+}
+
+// fmajor index rebuild
+func indexRebuildCommand(args []string) error {
+	fs := flag.NewFlagSet("index rebuild", flag.ExitOnError)
+	fs.Parse(args)
+
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	if err := RebuildIndex(); err != nil {
+		return err
+	}
+
+	if err := RebuildSearchIndex(); err != nil {
+		return err
+	}
+
+	files, _, err := GetFileIndex().Query(&FileQuery{})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "indexed %v files\n", len(files))
+	return nil
+}
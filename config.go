@@ -9,7 +9,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+)
+
+// Names of the supported storage backends. See Config.StorageBackend.
+const (
+	STORAGE_BACKEND_DIRECTORY = "directory"
+	STORAGE_BACKEND_S3        = "s3"
 )
 
 // Configuration of a fmajor instance.
@@ -29,6 +37,57 @@ type Config struct {
 	// on this directory.
 	UploadsDirectory string
 
+	// The directory where to put incomplete uploads. If left empty,
+	// directory ".staging" inside UploadsDirectory is used.
+	//
+	// The process running fmajor will need rw permissions
+	// on this directory.
+	StagingDirectory string
+
+	// The file where to keep API tokens. If left empty, file
+	// ".tokens.json" inside UploadsDirectory is used.
+	TokensFile string
+
+	// Where to store uploaded files. Either "directory" which stores
+	// all files in UploadsDirectory or "s3" which stores all files in
+	// an S3-compatible bucket. If left empty, "directory" is used.
+	StorageBackend string
+
+	// Base URL of the S3 API, for example "https://s3.eu-central-1.amazonaws.com"
+	// or "http://localhost:9000". Only used with StorageBackend "s3".
+	S3Endpoint string
+
+	// Region of the bucket. Self-hosted S3 implementations usually
+	// accept "us-east-1". Only used with StorageBackend "s3".
+	S3Region string
+
+	// Name of the bucket to store files in. Only used with StorageBackend
+	// "s3".
+	S3Bucket string
+
+	// Optional prefix for all keys fmajor creates in the bucket, for
+	// example "fmajor/". Only used with StorageBackend "s3".
+	S3Prefix string
+
+	// Credentials for accessing the bucket. If left empty, the values
+	// of environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	// are used instead. Only used with StorageBackend "s3".
+	S3AccessKey string
+	S3SecretKey string
+
+	// If set to a positive duration like "15m", downloads are not
+	// streamed through fmajor. Instead, clients are redirected to a
+	// presigned URL which is valid for the given duration. Only used
+	// with StorageBackend "s3" and without encryption at rest (see
+	// EncryptionKeyFile).
+	S3PresignLifetime time.Duration
+
+	// File containing the master key for encrypting uploads at rest,
+	// 64 hex characters as printed by "fmajor key generate". If left
+	// empty and environment variable FMAJOR_ENCRYPTION_KEY is not set
+	// either, uploads are stored unencrypted.
+	EncryptionKeyFile string
+
 	// Maximum file size in bytes. Stored as signed integer
 	// because the http API where we use MaxFileSize requires
 	// a signed integer.
@@ -43,9 +102,19 @@ type Config struct {
 	//
 	//   $2y$12$BkkH3A/W67qKQ7vwCxwcPOf4XllhwNWxTV5Pl4Zb1aLd1bd4Ga5m2
 	//
+	// These passwords are not associated with any user. Logging in
+	// with them grants admin rights. Prefer setting up Users instead.
 	PassHashes []string
+
+	// User accounts. Each user has a name, a bcrypt password hash
+	// (see PassHashes) and a role, either "user" or "admin".
+	Users []User
 }
 
+// Path to the configuration file as supplied with the -c flag. Empty
+// if the flag was not supplied.
+var configFlag = flag.String("c", "", "path to configuration file")
+
 // Global instance of the configuration. Use GetConfig to access
 // this variable.
 var config *Config
@@ -72,12 +141,50 @@ func (c *Config) Error() error {
 		return errors.New("empty UploadsDirecotry")
 	}
 
+	switch c.StorageBackend {
+	case "", STORAGE_BACKEND_DIRECTORY:
+	case STORAGE_BACKEND_S3:
+		if c.S3Endpoint == "" {
+			return errors.New("empty S3Endpoint")
+		}
+
+		if c.S3Region == "" {
+			return errors.New("empty S3Region")
+		}
+
+		if c.S3Bucket == "" {
+			return errors.New("empty S3Bucket")
+		}
+
+		if c.S3Prefix != "" && !strings.HasSuffix(c.S3Prefix, "/") {
+			return fmt.Errorf(`S3Prefix="%v" does not end in a slash`, c.S3Prefix)
+		}
+	default:
+		return fmt.Errorf(`unknown StorageBackend="%v"`, c.StorageBackend)
+	}
+
 	if c.MaxFileSize <= 0 {
 		return fmt.Errorf("bad MaxFileSize=%v", c.MaxFileSize)
 	}
 
-	if len(c.PassHashes) == 0 {
-		return errors.New("empty PassHashes")
+	if len(c.PassHashes) == 0 && len(c.Users) == 0 {
+		return errors.New("empty PassHashes and Users")
+	}
+
+	names := make(map[string]bool)
+
+	for i := range c.Users {
+		u := &c.Users[i]
+
+		if err := u.Error(); err != nil {
+			return err
+		}
+
+		if names[u.Name] {
+			return fmt.Errorf(`duplicate user="%v"`, u.Name)
+		}
+
+		names[u.Name] = true
 	}
 
 	return nil
@@ -121,10 +228,7 @@ func configPaths() []string {
 	// first check whether the user supplied the -c flag; if they did,
 	// only consider that file
 
-	var custom string
-	flag.StringVar(&custom, "c", "/dev/null", "path to configuration file")
-	flag.Parse()
-	if custom != "/dev/null" {
+	if custom := *configFlag; custom != "" {
 		return []string{
 			custom,
 		}
@@ -164,5 +268,13 @@ func loadConfigFrom(filename string) (*Config, error) {
 		return nil, errors.Wrapf(err, `filename="%v" not a valid config file`, filename)
 	}
 
+	if c.StagingDirectory == "" {
+		c.StagingDirectory = filepath.Join(c.UploadsDirectory, ".staging")
+	}
+
+	if c.TokensFile == "" {
+		c.TokensFile = filepath.Join(c.UploadsDirectory, ".tokens.json")
+	}
+
 	return &c, nil
 }
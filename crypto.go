@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encryption at rest. If a master key is configured, storage backends
+// encrypt every blob and all content before it hits the disk or the
+// bucket. Encrypted blobs ("sealed" blobs) look like this:
+//
+//	magic        8 bytes, SEAL_MAGIC
+//	key id       8 bytes, see MasterKey.Id
+//	wrap nonce  12 bytes
+//	data key    48 bytes, random AES-256 key sealed with the master key
+//	prefix       7 bytes, random nonce prefix for the chunks
+//	chunks      each at most SEAL_CHUNK_SIZE bytes of plain text sealed
+//	            with the data key
+//
+// Each chunk is sealed with AES-256-GCM. Its nonce is the prefix followed
+// by the chunk index and a flag that marks the last chunk. This way chunks
+// cannot be reordered or dropped without us noticing, yet we can decrypt
+// any chunk on its own which allows for serving range requests. As the data
+// key only ever exists wrapped in the header, rotating the master key only
+// has to rewrite headers.
+//
+// Blobs without SEAL_MAGIC are read as they are. This allows for turning
+// on encryption for existing installations. Content is user data that
+// might start with SEAL_MAGIC by chance, so storage backends record
+// whether they sealed it, see Sealing.
+const (
+	SEAL_MAGIC       = "fmajor\x00\x01"
+	SEAL_CHUNK_SIZE  = 64 * 1024
+	SEAL_HEADER_SIZE = len(SEAL_MAGIC) + KEY_ID_SIZE + 12 + 32 + 16 + SEAL_PREFIX_SIZE
+
+	// Environment variable that may contain the master key. Takes
+	// precedence over Config.EncryptionKeyFile.
+	ENCRYPTION_KEY_ENV = "FMAJOR_ENCRYPTION_KEY"
+)
+
+const (
+	KEY_ID_SIZE      = 8
+	SEAL_PREFIX_SIZE = 7
+)
+
+// Whether a blob is sealed as recorded by the storage backend.
+type Sealing int
+
+const (
+	// Nothing is recorded, either because the blob was stored before
+	// we recorded it or because it is a thumbnail, which can only start
+	// with SEAL_MAGIC if it is sealed. Such blobs are sealed if they
+	// start with a header we can unwrap, see MasterKey.Unseal.
+	SEALING_UNKNOWN Sealing = iota
+
+	// The blob is stored as it is, whatever its first bytes look like.
+	SEALING_PLAIN
+
+	// The blob is sealed.
+	SEALING_SEALED
+)
+
+// Return the sealing of blobs written with key mk, i.e. sealed unless
+// mk is nil.
+func (mk *MasterKey) Sealing() Sealing {
+	if mk == nil {
+		return SEALING_PLAIN
+	}
+
+	return SEALING_SEALED
+}
+
+// Key that protects the data keys of all sealed blobs.
+type MasterKey struct {
+	aead cipher.AEAD
+	id   [KEY_ID_SIZE]byte
+}
+
+// Parse a master key encoded as 64 hex characters. Surrounding white
+// space is ignored.
+func ParseMasterKey(s string) (*MasterKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key is not 64 hex characters")
+	}
+
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	mk := &MasterKey{aead: aead}
+
+	hash := sha256.Sum256(key)
+	copy(mk.id[:], hash[:])
+
+	return mk, nil
+}
+
+// Load a master key from filename. See ParseMasterKey for the format.
+func LoadMasterKeyFile(filename string) (*MasterKey, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read encryption key file")
+	}
+
+	mk, err := ParseMasterKey(string(bs))
+	if err != nil {
+		return nil, errors.Wrapf(err, `bad encryption key file="%v"`, filename)
+	}
+
+	return mk, nil
+}
+
+// Return a new random master key encoded as accepted by ParseMasterKey.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "cannot generate encryption key")
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// Load the master key as configured in c, either from the environment
+// or from Config.EncryptionKeyFile. Returns nil if no key is configured,
+// that is if encryption at rest is turned off.
+func loadMasterKey(c *Config) (*MasterKey, error) {
+	if s := os.Getenv(ENCRYPTION_KEY_ENV); s != "" {
+		mk, err := ParseMasterKey(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad %v", ENCRYPTION_KEY_ENV)
+		}
+
+		return mk, nil
+	}
+
+	if c.EncryptionKeyFile != "" {
+		return LoadMasterKeyFile(c.EncryptionKeyFile)
+	}
+
+	return nil, nil
+}
+
+// Return a short identifier for this key that is safe to store and
+// print. We record it in every header so we can tell which key sealed
+// a blob.
+func (mk *MasterKey) Id() string {
+	return hex.EncodeToString(mk.id[:])
+}
+
+// Return a writer that seals everything written to it with a new data
+// key and writes the result to w. Close the returned writer to write
+// the last chunk; this does not close w. If mk is nil, everything is
+// written to w as it is.
+func (mk *MasterKey) NewSealer(w io.Writer) (io.WriteCloser, error) {
+	if mk == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	dataKey := make([]byte, 32)
+	header := make([]byte, SEAL_HEADER_SIZE)
+	prefix := header[SEAL_HEADER_SIZE-SEAL_PREFIX_SIZE:]
+
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrap(err, "cannot generate data key")
+	}
+
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, errors.Wrap(err, "cannot generate nonce prefix")
+	}
+
+	if err := mk.wrap(header, dataKey); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "cannot write header")
+	}
+
+	sw := &sealWriter{
+		w:      w,
+		aead:   aead,
+		prefix: append([]byte(nil), prefix...),
+		buf:    make([]byte, 0, SEAL_CHUNK_SIZE),
+	}
+
+	return sw, nil
+}
+
+// Open raw for reading plain text. If raw is sealed, returns a Blob that
+// decrypts raw on the fly. Otherwise raw is returned as it is. Takes
+// ownership of raw, i.e. raw is closed on error.
+//
+// Blobs with SEALING_UNKNOWN that start with SEAL_MAGIC are only read as
+// sealed if their key id is ours and we can unwrap their data key; when
+// no key is configured, we cannot tell and report an error.
+func (mk *MasterKey) Unseal(raw Blob, sealing Sealing) (Blob, error) {
+	if sealing == SEALING_PLAIN {
+		return raw, nil
+	}
+
+	header := make([]byte, SEAL_HEADER_SIZE)
+
+	_, err := io.ReadFull(raw, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		raw.Close()
+		return nil, errors.Wrap(err, "cannot read header")
+	}
+
+	sealed := err == nil && IsSealed(header)
+
+	if sealing == SEALING_SEALED && !sealed {
+		raw.Close()
+		return nil, errors.New("blob is recorded as encrypted but has no valid header")
+	}
+
+	if sealing == SEALING_UNKNOWN && sealed && mk != nil {
+		_, err := mk.unwrap(header)
+		sealed = err == nil
+	}
+
+	if !sealed {
+		if _, err := raw.Seek(0, io.SeekStart); err != nil {
+			raw.Close()
+			return nil, err
+		}
+
+		return raw, nil
+	}
+
+	sb, err := mk.unseal(raw, header)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return sb, nil
+}
+
+func (mk *MasterKey) unseal(raw Blob, header []byte) (*sealedBlob, error) {
+	if mk == nil {
+		return nil, errors.New("blob is encrypted but no encryption key is configured")
+	}
+
+	dataKey, err := mk.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// figure out the size of the plain text; each chunk, even an
+	// empty last chunk, carries aead.Overhead() bytes of tag
+
+	rawSize, err := raw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedChunkSize := int64(SEAL_CHUNK_SIZE + aead.Overhead())
+	body := rawSize - int64(SEAL_HEADER_SIZE)
+	nchunks := (body + sealedChunkSize - 1) / sealedChunkSize
+
+	if nchunks == 0 || body-(nchunks-1)*sealedChunkSize < int64(aead.Overhead()) {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+
+	sb := &sealedBlob{
+		raw:        raw,
+		aead:       aead,
+		prefix:     header[SEAL_HEADER_SIZE-SEAL_PREFIX_SIZE:],
+		rawSize:    rawSize,
+		rawOffset:  rawSize,
+		nchunks:    nchunks,
+		size:       body - nchunks*int64(aead.Overhead()),
+		chunkIndex: -1,
+	}
+
+	// an empty blob consists of only the last chunk; as Read never
+	// needs to look at it, check it now so truncation is detected
+
+	if sb.size == 0 {
+		if err := sb.load(0); err != nil {
+			return nil, err
+		}
+	}
+
+	return sb, nil
+}
+
+// Return header of a blob with given sealing with the data key wrapped
+// by from re-wrapped with mk. Returns nil if the blob is not sealed or
+// is already wrapped by mk. Blobs with SEALING_UNKNOWN whose header from
+// cannot unwrap are not sealed but merely start with SEAL_MAGIC.
+func (mk *MasterKey) Rewrap(header []byte, from *MasterKey, sealing Sealing) ([]byte, error) {
+	sealed := len(header) == SEAL_HEADER_SIZE && IsSealed(header)
+
+	switch {
+	case sealing == SEALING_PLAIN:
+		return nil, nil
+	case sealing == SEALING_SEALED && !sealed:
+		return nil, errors.New("blob is recorded as encrypted but has no valid header")
+	case !sealed, bytes.Equal(keyIdOf(header), mk.id[:]):
+		return nil, nil
+	}
+
+	dataKey, err := from.unwrap(header)
+	if err != nil && sealing == SEALING_UNKNOWN {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := append([]byte(nil), header[:SEAL_HEADER_SIZE]...)
+
+	if err := mk.wrap(rewrapped, dataKey); err != nil {
+		return nil, err
+	}
+
+	return rewrapped, nil
+}
+
+// Return whether header starts like a sealed blob. Only a valid header
+// if the blob is known to be sealed, see Sealing.
+func IsSealed(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(SEAL_MAGIC))
+}
+
+// Fill in magic, key id, wrap nonce and wrapped data key in header.
+func (mk *MasterKey) wrap(header, dataKey []byte) error {
+	copy(header, SEAL_MAGIC)
+	copy(keyIdOf(header), mk.id[:])
+
+	nonce := wrapNonceOf(header)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Wrap(err, "cannot generate nonce")
+	}
+
+	mk.aead.Seal(wrappedKeyOf(header)[:0], nonce, dataKey, header[:len(SEAL_MAGIC)+KEY_ID_SIZE])
+
+	return nil
+}
+
+// Return the data key wrapped in header.
+func (mk *MasterKey) unwrap(header []byte) ([]byte, error) {
+	if id := keyIdOf(header); !bytes.Equal(id, mk.id[:]) {
+		return nil, fmt.Errorf(`blob is encrypted with unknown key id="%x"`, id)
+	}
+
+	dataKey, err := mk.aead.Open(nil, wrapNonceOf(header), wrappedKeyOf(header), header[:len(SEAL_MAGIC)+KEY_ID_SIZE])
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot unwrap data key")
+	}
+
+	return dataKey, nil
+}
+
+func keyIdOf(header []byte) []byte {
+	offset := len(SEAL_MAGIC)
+	return header[offset : offset+KEY_ID_SIZE]
+}
+
+func wrapNonceOf(header []byte) []byte {
+	offset := len(SEAL_MAGIC) + KEY_ID_SIZE
+	return header[offset : offset+12]
+}
+
+func wrappedKeyOf(header []byte) []byte {
+	offset := len(SEAL_MAGIC) + KEY_ID_SIZE + 12
+	return header[offset : offset+32+16]
+}
+
+// Return the nonce for chunk with given index.
+func chunkNonce(prefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, SEAL_PREFIX_SIZE+5)
+
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[SEAL_PREFIX_SIZE:], uint32(index))
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot set up cipher")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Writer returned by MasterKey.NewSealer.
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	sealed []byte
+	index  int64
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		// we only write out a full chunk once more data arrives;
+		// otherwise it could be the last chunk
+
+		if len(sw.buf) == SEAL_CHUNK_SIZE {
+			if err := sw.flush(false); err != nil {
+				return 0, err
+			}
+		}
+
+		k := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+k]
+		p = p[k:]
+	}
+
+	return n, nil
+}
+
+func (sw *sealWriter) Close() error {
+	return sw.flush(true)
+}
+
+func (sw *sealWriter) flush(last bool) error {
+	if sw.index > math.MaxUint32 {
+		return errors.New("blob too large to encrypt")
+	}
+
+	nonce := chunkNonce(sw.prefix, sw.index, last)
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], nonce, sw.buf, nil)
+
+	if _, err := sw.w.Write(sw.sealed); err != nil {
+		return err
+	}
+
+	sw.buf = sw.buf[:0]
+	sw.index += 1
+
+	return nil
+}
+
+// Blob returned by MasterKey.Unseal for sealed blobs. Decrypts one chunk
+// at a time as it is read.
+type sealedBlob struct {
+	raw       Blob
+	aead      cipher.AEAD
+	prefix    []byte
+	rawSize   int64
+	rawOffset int64
+	nchunks   int64
+
+	// size of and current offset into the plain text
+	size   int64
+	offset int64
+
+	// the currently decrypted chunk
+	chunk      []byte
+	chunkIndex int64
+	sealed     []byte
+}
+
+func (sb *sealedBlob) Read(p []byte) (int, error) {
+	if sb.offset >= sb.size {
+		return 0, io.EOF
+	}
+
+	index := sb.offset / SEAL_CHUNK_SIZE
+
+	if index != sb.chunkIndex {
+		if err := sb.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sb.chunk[sb.offset-index*SEAL_CHUNK_SIZE:])
+	sb.offset += int64(n)
+
+	return n, nil
+}
+
+func (sb *sealedBlob) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = sb.offset + offset
+	case io.SeekEnd:
+		abs = sb.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	sb.offset = abs
+	return abs, nil
+}
+
+func (sb *sealedBlob) Close() error {
+	return sb.raw.Close()
+}
+
+// Read and decrypt chunk with given index.
+func (sb *sealedBlob) load(index int64) error {
+	sealedChunkSize := int64(SEAL_CHUNK_SIZE + sb.aead.Overhead())
+	pos := int64(SEAL_HEADER_SIZE) + index*sealedChunkSize
+
+	// only seek if we have to; for some blobs, e.g. those stored
+	// in S3, seeking is expensive
+
+	if pos != sb.rawOffset {
+		if _, err := sb.raw.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+
+		sb.rawOffset = pos
+	}
+
+	n := sealedChunkSize
+	if rest := sb.rawSize - pos; rest < n {
+		n = rest
+	}
+
+	if int64(cap(sb.sealed)) < n {
+		sb.sealed = make([]byte, sealedChunkSize)
+	}
+
+	sealed := sb.sealed[:n]
+
+	if _, err := io.ReadFull(sb.raw, sealed); err != nil {
+		sb.rawOffset = -1
+		return errors.Wrapf(err, "cannot read chunk=%v", index)
+	}
+
+	sb.rawOffset += n
+
+	last := index == sb.nchunks-1
+	chunk, err := sb.aead.Open(sb.chunk[:0], chunkNonce(sb.prefix, index, last), sealed, nil)
+	if err != nil {
+		sb.chunkIndex = -1
+		return errors.Wrapf(err, "cannot decrypt chunk=%v", index)
+	}
+
+	sb.chunk = chunk
+	sb.chunkIndex = index
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kissen/stringset"
+	"github.com/pkg/errors"
+)
+
+// Content encodings we use for compressing files at rest. The names
+// match the values of the Content-Encoding header.
+const (
+	ENCODING_GZIP = "gzip"
+)
+
+// How many bytes at the start of an upload we look at to figure out
+// whether it is text. This is all http.DetectContentType considers.
+const SNIFF_LEN = 512
+
+// Contains mime types besides text/* that usually compress well. Types
+// that are compressed already, like most images or archives, are missing
+// on purpose.
+var compressibleMimeTypes stringset.StringSet
+
+func init() {
+	compressibleMimeTypes = stringset.NewWith(
+		"application/json", "application/ld+json", "application/x-ndjson",
+		"application/xml", "application/javascript", "application/x-yaml",
+		"application/yaml", "application/sql", "application/x-sh",
+		"image/svg+xml", "image/bmp", "application/x-tar",
+	)
+}
+
+// Return the encoding to store a file with given content type in.
+// head are the first bytes of the file; if the content type is not
+// telling, we check whether head looks like text. Returns an empty
+// string if the file should be stored as it is.
+func encodingFor(contentType string, head []byte) string {
+	if isCompressible(contentType) {
+		return ENCODING_GZIP
+	}
+
+	// many log files have extensions that do not map to any content
+	// type; only for these we look at the actual data
+
+	if contentType == "" || contentType == "application/octet-stream" {
+		if isCompressible(http.DetectContentType(head)) {
+			return ENCODING_GZIP
+		}
+	}
+
+	return ""
+}
+
+// Return whether contentType is text or in compressibleMimeTypes.
+// Parameters like the charset are ignored.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || compressibleMimeTypes.Contains(mediaType)
+}
+
+// Return whether the client that sent r accepts responses encoded with
+// encoding as indicated by the Accept-Encoding header.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	accepted := map[string]bool{}
+
+	for _, field := range r.Header.Values("Accept-Encoding") {
+		for _, element := range strings.Split(field, ",") {
+			parts := strings.Split(element, ";")
+			coding := strings.ToLower(strings.TrimSpace(parts[0]))
+
+			accepted[coding] = true
+
+			// a quality of zero, e.g. "gzip;q=0", means the
+			// client does not accept that coding
+
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+				if q, err := strconv.ParseFloat(value, 64); name == "q" && err == nil && q == 0 {
+					accepted[coding] = false
+				}
+			}
+		}
+	}
+
+	if ok, listed := accepted[encoding]; listed {
+		return ok
+	}
+
+	return accepted["*"]
+}
+
+// Reader that returns everything read from src compressed with gzip.
+type gzipReader struct {
+	src     io.Reader
+	zw      *gzip.Writer
+	buf     bytes.Buffer
+	scratch []byte
+	eof     bool
+}
+
+// Return a reader that compresses everything read from src with gzip.
+// Unlike piping through a gzip.Writer, this needs no goroutine.
+func newGzipReader(src io.Reader) io.Reader {
+	gr := &gzipReader{src: src, scratch: make([]byte, 32*1024)}
+	gr.zw = gzip.NewWriter(&gr.buf)
+
+	return gr
+}
+
+func (gr *gzipReader) Read(p []byte) (int, error) {
+	for gr.buf.Len() == 0 && !gr.eof {
+		n, err := gr.src.Read(gr.scratch)
+
+		if n > 0 {
+			if _, err := gr.zw.Write(gr.scratch[:n]); err != nil {
+				return 0, err
+			}
+		}
+
+		if err == io.EOF {
+			if err := gr.zw.Close(); err != nil {
+				return 0, err
+			}
+
+			gr.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if gr.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return gr.buf.Read(p)
+}
+
+// Blob that decompresses a gzip encoded blob on the fly. Seeking
+// forward skips over decompressed data, seeking backwards starts over
+// from the beginning. This is slow for random access but good enough
+// for the occasional range request.
+type gunzipBlob struct {
+	raw Blob
+	zr  *gzip.Reader
+
+	// size of and current offset into the decompressed data
+	size   int64
+	offset int64
+
+	// offset zr is at
+	zoffset int64
+}
+
+// Return a Blob that decompresses raw, which decompresses to size
+// bytes. Takes ownership of raw.
+func newGunzipBlob(raw Blob, size int64) Blob {
+	return &gunzipBlob{raw: raw, size: size}
+}
+
+func (gb *gunzipBlob) Read(p []byte) (int, error) {
+	if gb.offset >= gb.size {
+		return 0, io.EOF
+	}
+
+	if gb.zr == nil || gb.zoffset > gb.offset {
+		if err := gb.rewind(); err != nil {
+			return 0, err
+		}
+	}
+
+	if gb.zoffset < gb.offset {
+		skipped, err := io.CopyN(ioutil.Discard, gb.zr, gb.offset-gb.zoffset)
+		gb.zoffset += skipped
+
+		if err != nil {
+			return 0, errors.Wrap(err, "cannot skip compressed data")
+		}
+	}
+
+	n, err := gb.zr.Read(p)
+	gb.offset += int64(n)
+	gb.zoffset += int64(n)
+
+	return n, err
+}
+
+func (gb *gunzipBlob) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = gb.offset + offset
+	case io.SeekEnd:
+		abs = gb.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	gb.offset = abs
+	return abs, nil
+}
+
+func (gb *gunzipBlob) Close() error {
+	return gb.raw.Close()
+}
+
+// Start decompressing from the beginning of raw.
+func (gb *gunzipBlob) rewind() error {
+	if _, err := gb.raw.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var err error
+
+	if gb.zr == nil {
+		gb.zr, err = gzip.NewReader(gb.raw)
+	} else {
+		err = gb.zr.Reset(gb.raw)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "cannot decompress")
+	}
+
+	gb.zoffset = 0
+	return nil
+}
+
+// ResponseWriter that adds a Content-Encoding header once the status
+// is written. See ServeBlob.
+type encodingWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+}
+
+func (ew *encodingWriter) WriteHeader(code int) {
+	if ew.wroteHeader {
+		return
+	}
+
+	ew.wroteHeader = true
+
+	// error responses, e.g. for unsatisfiable ranges, are not
+	// encoded
+
+	if code < 400 {
+		ew.Header().Set("Content-Encoding", ew.encoding)
+	}
+
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	ew.WriteHeader(http.StatusOK)
+	return ew.ResponseWriter.Write(p)
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image"
 	"io"
 	"io/fs"
-	"io/ioutil"
 	"log"
 	"mime"
+	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/TwiN/go-away"
@@ -23,6 +26,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/kissen/stringset"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Maximum size an image may be for us to compute a thumbnail.  Unfortunately we
@@ -46,6 +50,20 @@ var inlineMimeTypes stringset.StringSet
 // Contains image mime types.
 var imageMimeTypes stringset.StringSet
 
+// Categories of files the listing can be filtered by. See File.Category.
+const (
+	CATEGORY_IMAGES    = "images"
+	CATEGORY_DOCUMENTS = "documents"
+	CATEGORY_ARCHIVES  = "archives"
+)
+
+// Contains the mime types of office documents and the like. Together
+// with text/* these make up CATEGORY_DOCUMENTS.
+var documentMimeTypes stringset.StringSet
+
+// Contains the mime types of archives and compressed files.
+var archiveMimeTypes stringset.StringSet
+
 func init() {
 	// Initalize inlineMimeTypes. Based on a list of common MIME described types on
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/MIME_types/Common_types
@@ -66,6 +84,23 @@ func init() {
 		"image/bmp", "image/gif", "image/jpeg", "image/png",
 		"image/webp",
 	)
+
+	documentMimeTypes = stringset.NewWith(
+		"application/pdf", "application/rtf", "application/epub+zip",
+		"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"application/vnd.oasis.opendocument.text", "application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.oasis.opendocument.presentation",
+	)
+
+	archiveMimeTypes = stringset.NewWith(
+		"application/zip", "application/x-tar", "application/gzip", "application/x-gzip",
+		"application/x-bzip", "application/x-bzip2", "application/x-xz", "application/zstd",
+		"application/x-7z-compressed", "application/vnd.rar", "application/x-rar-compressed",
+		"application/java-archive",
+	)
 }
 
 type File struct {
@@ -82,6 +117,10 @@ type File struct {
 	// When the file was originally uploaded.
 	UploadedOnUTC time.Time
 
+	// When the file should be deleted. Nil when the file should
+	// be kept forever.
+	ExpiresOnUTC *time.Time
+
 	// An infered content type for this file.
 	ContentType string
 
@@ -90,6 +129,53 @@ type File struct {
 
 	// Shortened Id.
 	ShortId *string
+
+	// How often the file may be downloaded before it is deleted.
+	// Nil when there is no limit.
+	MaxDownloads *int
+
+	// How often the file was downloaded so far. Only counted for
+	// files with MaxDownloads set.
+	Downloads int
+
+	// Bcrypt hash of the password visitors have to enter before
+	// they may download this file. Nil if the file is not password
+	// protected.
+	PassHash *string
+
+	// Name of the user who uploaded this file. Empty for files
+	// uploaded by legacy users (see Config.PassHashes) or before
+	// fmajor knew about users.
+	Owner string
+
+	// Hex encoded SHA-256 hash of the contents of this file as
+	// stored, that is after encoding with ContentEncoding. The
+	// contents are stored as content with this hash, see Storage.
+	// Empty for files uploaded before we had content-addressed
+	// storage; their contents are stored in blob STORAGE_BLOB.
+	ContentHash string
+
+	// How the stored contents are encoded, e.g. "gzip" for files
+	// compressed at rest. Empty if they are stored as uploaded.
+	ContentEncoding string
+
+	// Size of the stored contents in bytes. Only set if ContentEncoding
+	// is set; otherwise it is the same as Size.
+	EncodedSize int64
+
+	// Hex encoded SHA-256 hash of the contents of this file as
+	// uploaded. Empty for files uploaded before we recorded it; see
+	// Checksum.
+	Sha256 string
+
+	// Names of the collections this file is in, sorted. Empty if it
+	// is in none.
+	Collections []string `json:",omitempty"`
+
+	// Path of this file relative to the folder it was uploaded with,
+	// e.g. "docs/intro.md". Empty for files not uploaded as part of
+	// a folder.
+	Path string `json:",omitempty"`
 }
 
 // Return whether any of the fields are set to their zero-value.
@@ -124,6 +210,36 @@ func (f *File) HumanSize() string {
 	}
 }
 
+// Return the hex encoded SHA-256 hash of the contents of this file as
+// uploaded. Returns false if we do not know it.
+func (f *File) Checksum() (string, bool) {
+	if f.Sha256 != "" {
+		return f.Sha256, true
+	}
+
+	if f.HasContent() && f.ContentEncoding == "" {
+		return f.ContentHash, true
+	}
+
+	return "", false
+}
+
+// Return whether the contents of this file are stored encoded, e.g.
+// compressed.
+func (f *File) IsEncoded() bool {
+	return f.ContentEncoding != ""
+}
+
+// Return the number of bytes the contents of this file take up in
+// storage.
+func (f *File) StoredSize() int64 {
+	if f.IsEncoded() {
+		return f.EncodedSize
+	}
+
+	return f.Size
+}
+
 // Return whether the file should be inlined, that is shown as-is
 // in the browser. This makes sense for images and simple text files.
 func (f *File) Inline() bool {
@@ -135,20 +251,116 @@ func (f *File) HumanUploadedOn() string {
 	return f.UploadedOnUTC.Format("2006-01-02 15:04")
 }
 
+// Return whether the file has passed its expiry date. Expired files
+// should not be served anymore.
+func (f *File) Expired() bool {
+	return f.ExpiresOnUTC != nil && time.Now().UTC().After(*f.ExpiresOnUTC)
+}
+
+// Return expiry timestamp as human-readable string.
+func (f *File) HumanExpiresOn() string {
+	if f.ExpiresOnUTC == nil {
+		return "never"
+	}
+
+	return f.ExpiresOnUTC.Format("2006-01-02 15:04")
+}
+
+// Return whether the file has been downloaded as often as allowed.
+// Exhausted files should not be served anymore.
+func (f *File) Exhausted() bool {
+	return f.MaxDownloads != nil && f.Downloads >= *f.MaxDownloads
+}
+
+// Return whether the number of downloads is limited.
+func (f *File) HasDownloadLimit() bool {
+	return f.MaxDownloads != nil
+}
+
+// Return download count and limit as human-readable string.
+func (f *File) HumanDownloads() string {
+	if f.MaxDownloads == nil {
+		return strconv.Itoa(f.Downloads)
+	}
+
+	return fmt.Sprintf("%v/%v", f.Downloads, *f.MaxDownloads)
+}
+
+// Return whether visitors need to enter a password before they may
+// download this file.
+func (f *File) HasPassword() bool {
+	return f.PassHash != nil
+}
+
+// Return whether pass is the password of this file.
+func (f *File) IsValidPassword(pass string) bool {
+	if f.PassHash == nil {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(*f.PassHash), []byte(pass)) == nil
+}
+
 // Return whether the underlying File is an image. This is used to determine
 // whether a thumbnail should be displayed.
 func (f *File) IsImage() bool {
 	return imageMimeTypes.Contains(f.ContentType)
 }
 
+// Return the category of this file, one of the CATEGORY_* constants.
+// Returns an empty string if the file fits no category.
+func (f *File) Category() string {
+	mediaType, _, err := mime.ParseMediaType(f.ContentType)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return CATEGORY_IMAGES
+	case strings.HasPrefix(mediaType, "text/") || documentMimeTypes.Contains(mediaType):
+		return CATEGORY_DOCUMENTS
+	case archiveMimeTypes.Contains(mediaType):
+		return CATEGORY_ARCHIVES
+	default:
+		return ""
+	}
+}
+
 func (f *File) HasThumbnail() bool {
 	return f.ThumbnailSize != nil
 }
 
-// Return path on local file system to this file's thumbnail. Note that
-// this thumbnail is not guranteed to exist.
-func (f *File) LocalThumbnailPath() string {
-	return f.pathTo("thumbnail.jpg")
+// Return the path of this file inside the folder it was uploaded with
+// or, for files not uploaded as part of a folder, its name.
+func (f *File) DisplayPath() string {
+	if f.Path != "" {
+		return f.Path
+	}
+
+	return f.Name
+}
+
+// Return the absolute path under which the contents of this file
+// are served.
+func (f *File) Url() string {
+	return "/files/" + f.Id + "/" + url.PathEscape(f.Name)
+}
+
+// Return the absolute path under which the thumbnail of this file
+// is served. Note that this thumbnail is not guaranteed to exist.
+func (f *File) ThumbnailUrl() string {
+	return "/thumbnails/" + f.Id + "/thumbnail.jpg"
+}
+
+// Return whether the contents of this file are stored as shared
+// content rather than in its own blob.
+func (f *File) HasContent() bool {
+	return f.ContentHash != ""
+}
+
+func (f *File) HasOwner() bool {
+	return f.Owner != ""
 }
 
 func (f *File) HasShortUrl() bool {
@@ -162,253 +374,491 @@ func (f *File) ShortUrl() string {
 	return path.Join(host, "f", *id)
 }
 
-func (f *File) LocalPath() string {
-	return f.pathTo("storage.bin")
-}
-
-// Get a listing of all uploaded files.
+// Get a listing of all uploaded files, newest first.
 //
 // Only call this function if you are holding the global read lock.
-func Files() (uploads []*File, err error) {
-	uploadsDirectory := GetConfig().UploadsDirectory
+func Files() ([]*File, error) {
+	files, _, err := GetFileIndex().Query(&FileQuery{Sort: SORT_UPLOADED, Descending: true})
+	return files, err
+}
+
+// How much storage a set of files takes up. Thumbnails and metadata
+// are not taken into account, see FileIndex.Usage.
+type StorageUsage struct {
+	// Number of files.
+	Files int
+
+	// Sum of the sizes of all files. This is how much storage
+	// we would need without deduplication.
+	LogicalSize int64
 
-	fis, err := ioutil.ReadDir(uploadsDirectory)
+	// How much storage the contents of all files actually take
+	// up. Files with the same contents are only counted once.
+	PhysicalSize int64
+}
+
+// Return LogicalSize as a human-readable string.
+func (u *StorageUsage) HumanLogicalSize() string {
+	return humanize.IBytes(uint64(u.LogicalSize))
+}
+
+// Return PhysicalSize as a human-readable string.
+func (u *StorageUsage) HumanPhysicalSize() string {
+	return humanize.IBytes(uint64(u.PhysicalSize))
+}
+
+// Load the metadata for a previously uploaded file.
+//
+// Only call this function if you are holding the read lock of the
+// file (see LockFileRead) or the global lock.
+func LoadFile(id string) (*File, error) {
+	meta, err := GetStorage().GetMeta(id)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, fi := range fis {
-		if isSymlink(fi) {
-			continue
-		}
+	if meta.HasZero() {
+		return nil, errors.Wrapf(ErrBadMeta, `meta.json for id="%v" contains invalid values`, id)
+	}
 
-		if !isDir(fi) {
-			continue
-		}
+	return meta, nil
+}
+
+// Load the metadata for a previously uploaded file given its
+// short id.
+//
+// Only call this function if you are holding the global read lock.
+func LoadShort(shortId string) (*File, error) {
+	id, err := GetStorage().ResolveLink(shortId)
+	if err != nil {
+		return nil, err
+	}
 
-		id := fi.Name()
+	return LoadFile(id)
+}
 
-		if upload, err := LoadFile(id); err != nil {
-			log.Printf("problem while creating file listing: %v", err)
-		} else {
-			uploads = append(uploads, upload)
-		}
+// Open the contents of a previously uploaded file. Encoded contents
+// are decoded on the fly. Close the returned Blob when you are done
+// with it.
+//
+// Only call this function if you are holding the read lock of the
+// file (see LockFileRead) or the global lock.
+func OpenFile(f *File) (Blob, error) {
+	if !f.HasContent() {
+		return GetStorage().OpenBlob(f.Id, STORAGE_BLOB)
+	}
+
+	blob, err := GetStorage().OpenContent(f.ContentHash)
+	if err != nil {
+		return nil, err
 	}
 
-	sort.Slice(uploads, func(i, j int) bool {
-		return uploads[i].UploadedOnUTC.After(uploads[j].UploadedOnUTC)
-	})
+	switch f.ContentEncoding {
+	case "":
+		return blob, nil
+	case ENCODING_GZIP:
+		return newGunzipBlob(blob, f.Size), nil
+	default:
+		blob.Close()
+		return nil, fmt.Errorf(`unknown encoding="%v" for id="%v"`, f.ContentEncoding, f.Id)
+	}
+}
 
-	return
+// Open the contents of a previously uploaded file as stored, that is
+// still encoded with f.ContentEncoding. Close the returned Blob when
+// you are done with it.
+//
+// Only call this function if you are holding the read lock of the
+// file (see LockFileRead) or the global lock.
+func OpenEncodedFile(f *File) (Blob, error) {
+	return GetStorage().OpenContent(f.ContentHash)
 }
 
-// Load the metadata for a previously uploaded file.
+// Open the thumbnail of a previously uploaded file. Close the
+// returned Blob when you are done with it.
 //
-// Only call this function if you are holding the global read lock.
-func LoadFile(id string) (*File, error) {
-	storageDir := GetConfig().UploadsDirectory
-	baseDir := filepath.Join(storageDir, id)
-	metaPath := filepath.Join(baseDir, "meta.json")
+// Only call this function if you are holding the read lock of the
+// file (see LockFileRead) or the global lock.
+func OpenThumbnail(f *File) (Blob, error) {
+	return GetStorage().OpenBlob(f.Id, THUMBNAIL_BLOB)
+}
 
-	metabytes, err := ioutil.ReadFile(metaPath)
-	if err != nil {
-		return nil, errors.Wrapf(err, `cannot open meta.json for id="%v"`, id)
+// Return an URL that allows clients to download blob name of file f
+// directly from the storage backend. Returns false if the backend does
+// not support this or if it is disabled.
+//
+// Only call this function if you are holding the read lock of the
+// file (see LockFileRead) or the global lock.
+func PresignedUrlFor(f *File, name string) (string, bool) {
+	presigner, ok := GetStorage().(Presigner)
+	if !ok {
+		return "", false
 	}
 
-	var meta File
-	if err := json.Unmarshal(metabytes, &meta); err != nil {
-		return nil, errors.Wrapf(err, `cannot parse meta.json for id="%v"`, id)
+	url, err := presigner.PresignBlob(f, name)
+	if err == ErrPresignDisabled {
+		return "", false
 	}
 
-	if meta.HasZero() {
-		return nil, fmt.Errorf(`meta.json for id="%v" contains invalid values`, id)
+	if err != nil {
+		log.Printf(`could not presign name="%v" for id="%v": %v`, name, f.Id, err)
+		return "", false
 	}
 
-	return &meta, nil
+	return url, true
+}
+
+// Options for creating a file with CreateFile.
+type CreateOptions struct {
+	// Whether to create a short link for the file.
+	CreateShortId bool
+
+	// How long to keep the file around before it expires. Zero
+	// means forever.
+	Lifetime time.Duration
+
+	// How often the file may be downloaded before it is deleted.
+	// Zero means no limit.
+	MaxDownloads int
+
+	// Bcrypt hash of the password protecting the file. Nil means
+	// no password. See HashPassword.
+	PassHash *string
+
+	// Name of the user uploading the file.
+	Owner string
+
+	// Names of the collections to put the file into.
+	Collections []string
+
+	// Whether to create collections that do not exist yet for Owner.
+	// They are only created once the file is stored, so failed
+	// uploads do not leave behind empty collections.
+	CreateCollections bool
+
+	// Path of the file relative to the folder it is uploaded with.
+	// Empty for files not uploaded as part of a folder.
+	Path string
 }
 
 // Given a reader that contains bytes for a file, store those contents
 // as a new file in the storage directory. Returns the metadata for the
 // created file.
 //
-// Only call this function if you are holding the global write lock.
-func CreateFile(src io.Reader, filename string, createShortId bool) (*File, error) {
+// Reading src can take a long time, so this function takes the locks
+// it needs itself and only holds them briefly. Do not call it while
+// holding any lock.
+func CreateFile(src io.Reader, filename string, opts *CreateOptions) (*File, error) {
 	// figure out meta data
 
 	id := uuid.New().String()
+	contentType := mime.TypeByExtension(path.Ext(filename))
 
-	storageDir := GetConfig().UploadsDirectory
-	baseDir := filepath.Join(storageDir, id)
-	metaPath := filepath.Join(baseDir, "meta.json")
-	storagePath := filepath.Join(baseDir, "storage.bin")
+	// compress files that are likely to compress well; this needs
+	// a peek at the data for files without a telling extension
 
-	// create the directory where all related files are going to be stored
+	buffered := bufio.NewReaderSize(src, SNIFF_LEN)
+	head, _ := buffered.Peek(SNIFF_LEN)
+	encoding := encodingFor(contentType, head)
 
-	if err := os.Mkdir(baseDir, 0700); err != nil {
-		return nil, errors.Wrapf(err, `cannot create directory for filename="%v"`, filename)
+	// we need size and hash of the file as uploaded, not as stored
+
+	hasher := sha256.New()
+	counter := &countingWriter{}
+
+	// collect the terms for the search index on the way, but only
+	// for files that contain text
+
+	hashed := io.MultiWriter(hasher, counter)
+	terms := &termCollector{}
+
+	if isSearchable(contentType, filename) {
+		hashed = io.MultiWriter(hasher, counter, terms)
 	}
 
-	// copy in the actual file
+	stored := io.TeeReader(buffered, hashed)
 
-	fd, err := os.Create(storagePath)
-	if err != nil {
-		DeleteFileAsync(id)
-		return nil, errors.Wrapf(err, `cannot create storage.bin for id="%v" filename="%v"`, id, filename)
+	if encoding == ENCODING_GZIP {
+		stored = newGzipReader(stored)
 	}
 
-	defer fd.Close()
+	// copy in the actual file; this is the slow part, so we do it
+	// before taking any lock
 
-	nbytes, err := io.Copy(fd, src)
+	spool, err := GetStorage().SpoolContent(stored)
 	if err != nil {
-		DeleteFileAsync(id)
-		return nil, errors.Wrapf(err, `cannot write storage.bin for id="%v" filename="%v"`, id, filename)
+		return nil, errors.Wrapf(err, `cannot store filename="%v"`, filename)
+	}
+
+	defer spool.Discard()
+
+	// if we already have the same contents, the storage backend
+	// only stores them once
+
+	hash := spool.Hash
+	lease := LockWrite()
+
+	if err := GetStorage().PutContent(spool); err != nil {
+		lease.Unlock()
+		return nil, errors.Wrapf(err, `cannot store filename="%v"`, filename)
 	}
 
+	lease.Unlock()
+
 	// create the meta object
 
 	meta := File{
-		Id:            id,
-		Name:          filename,
-		Size:          nbytes,
-		UploadedOnUTC: time.Now().UTC(),
-		ContentType:   mime.TypeByExtension(path.Ext(filename)),
+		Id:              id,
+		Name:            filename,
+		Size:            counter.n,
+		UploadedOnUTC:   time.Now().UTC(),
+		ContentType:     contentType,
+		ContentHash:     hash,
+		ContentEncoding: encoding,
+		Sha256:          hex.EncodeToString(hasher.Sum(nil)),
+	}
+
+	if meta.IsEncoded() {
+		meta.EncodedSize = spool.Size
+	}
+
+	// from here on, if anything goes wrong, we need to give up our
+	// reference to the content as well as the short link if we got
+	// that far; only call cleanup while holding the write lock
+
+	cleanup := func() {
+		if meta.HasShortUrl() {
+			if err := GetStorage().DeleteLink(*meta.ShortId); err != nil {
+				log.Printf(`could not delete shortId="%v": %v`, *meta.ShortId, err)
+			}
+		}
+
+		if err := GetStorage().ReleaseContent(hash); err != nil {
+			log.Printf(`could not release hash="%v": %v`, hash, err)
+		}
 	}
 
 	if meta.ContentType == "" {
 		meta.ContentType = "application/octet-stream"
 	}
 
-	// create thumbnail if necessary
+	if opts.Lifetime > 0 {
+		expires := meta.UploadedOnUTC.Add(opts.Lifetime)
+		meta.ExpiresOnUTC = &expires
+	}
+
+	if opts.MaxDownloads > 0 {
+		maxDownloads := opts.MaxDownloads
+		meta.MaxDownloads = &maxDownloads
+	}
+
+	meta.PassHash = opts.PassHash
+	meta.Owner = opts.Owner
+	meta.Path = opts.Path
+
+	for _, name := range opts.Collections {
+		if !meta.InCollection(name) {
+			meta.Collections = append(meta.Collections, name)
+		}
+	}
+
+	sort.Strings(meta.Collections)
+
+	// create thumbnail if necessary; we hold a reference to the
+	// content, so nobody deletes it while we read it without a lock
+
+	blobs := make(map[string]io.Reader)
 
 	if meta.IsImage() {
-		if err = createThumbnailFor(&meta, baseDir); err != nil {
-			DeleteFileAsync(id)
+		thumbnail, err := renderThumbnailFor(&meta)
+		if err != nil {
+			lease := LockWrite()
+			cleanup()
+			lease.Unlock()
+
 			return nil, errors.Wrapf(err, "could not create thumbnail")
 		}
+
+		thumbnailSize := int64(thumbnail.Len())
+		meta.ThumbnailSize = &thumbnailSize
+		blobs[THUMBNAIL_BLOB] = thumbnail
 	}
 
+	// everything else is quick, so from here on we hold the write
+	// lock until the file is complete
+
+	lease = LockWrite()
+	defer lease.Unlock()
+
 	// create short link if requested
 
-	if createShortId {
+	if opts.CreateShortId {
 		if err = createShortIdFor(&meta); err != nil {
-			DeleteFile(id)
+			cleanup()
 			return nil, errors.Wrapf(err, "could not create short id")
 		}
 	}
 
-	// write out meta object as json
+	// collections might have been deleted while we were busy
 
-	metabytes, err := json.Marshal(&meta)
-	if err != nil {
-		DeleteFileAsync(id)
-		return nil, errors.Wrapf(err, `cannot construct meta.json for id="%v" filename="%v"`, id, filename)
+	if !opts.CreateCollections {
+		if err := checkCollections(meta.Collections); err != nil {
+			cleanup()
+			return nil, err
+		}
 	}
 
-	if err := ioutil.WriteFile(metaPath, metabytes, 400); err != nil {
-		DeleteFileAsync(id)
-		return nil, errors.Wrapf(err, `cannot write meta.json for id="%v" filename="%v"`, id, filename)
-	}
+	// write out meta object and thumbnail; until this succeeds, the
+	// file does not exist as far as everybody else is concerned
 
 	if meta.HasZero() {
-		DeleteFileAsync(id)
+		cleanup()
 		return nil, fmt.Errorf(`meta.json for id="%v" filename="%v" contains invalid values`, id, filename)
 	}
 
+	var created []string
+
+	if opts.CreateCollections {
+		if created, err = createMissingCollections(opts.Owner, meta.Collections); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	if err := GetStorage().PutFile(&meta, blobs); err != nil {
+		deleteCollections(created)
+		cleanup()
+		return nil, err
+	}
+
+	indexFile(&meta)
+
+	if err := GetSearchIndex().Add(id, terms.Terms()); err != nil {
+		log.Printf(`cannot index id="%v" for searching, run index rebuild to fix: %v`, id, err)
+	}
+
 	return &meta, nil
 }
 
-// Delete the file with id from the file system.
+// Delete the file with id from storage, including its short link and
+// its reference to its content.
 //
 // Only call this function if you are holding the global write lock.
 func DeleteFile(id string) error {
-	storageDir := GetConfig().UploadsDirectory
-	baseDir := filepath.Join(storageDir, id)
-
-	metaPath := filepath.Join(baseDir, "meta.json")
-	metaErr := os.Remove(metaPath)
+	// we need the metadata to find the short link and content; we
+	// still delete what we can if it is missing or broken
 
-	storagePath := filepath.Join(baseDir, "storage.bin")
-	storageErr := os.Remove(storagePath)
+	meta, err := GetStorage().GetMeta(id)
+	if err != nil {
+		meta = nil
+	}
 
-	thumbnailPath := filepath.Join(baseDir, "thumbnail.jpg")
-	os.Remove(thumbnailPath) // thumbnail might not exist
+	if meta != nil && meta.HasShortUrl() {
+		if err := GetStorage().DeleteLink(*meta.ShortId); err != nil {
+			return err
+		}
+	}
 
-	rmdirErr := os.Remove(baseDir)
+	if err := GetStorage().Delete(id); err != nil {
+		return err
+	}
 
-	if metaErr != nil {
-		return metaErr
+	if err := GetFileIndex().Delete(id); err != nil {
+		log.Printf(`cannot remove id="%v" from index, run fsck -repair to fix: %v`, id, err)
 	}
 
-	if storageErr != nil {
-		return storageErr
+	if err := GetSearchIndex().Remove(id); err != nil {
+		log.Printf(`cannot remove id="%v" from search index, run index rebuild to fix: %v`, id, err)
 	}
 
-	if rmdirErr != nil {
-		return rmdirErr
+	// only give up the content once the file is gone, otherwise we
+	// might end up with a file pointing to missing content
+
+	if meta != nil && meta.HasContent() {
+		return GetStorage().ReleaseContent(meta.ContentHash)
 	}
 
 	return nil
 }
 
-// In a new goroutine, acquire the write lock and try our best to
-// delete the directory for the file with given id.
+// Record a download of the file with given id. Returns the updated
+// metadata. Returns an error if the file is exhausted, i.e. it may
+// not be downloaded anymore.
 //
-// This function is handy when you (probably) created a broken
-// file upload and want to clean up everything it left behind.
-// In those cases, call DeleteFileAsync and whatever the upload
-// left behind will be deleted when convenient.
-//
-// This function does not return an error, rather it writes a
-// log message when it cannot delete the directory for given id.
-func DeleteFileAsync(id string) {
-	go func() {
-		lease := LockWrite()
-		defer lease.Unlock()
+// Only call this function if you are holding the write lock of the
+// file (see LockFileWrite) or the global write lock.
+func CountDownload(id string) (*File, error) {
+	meta, err := LoadFile(id)
+	if err != nil {
+		return nil, err
+	}
 
-		// the following logic is similar to DeleteFile; unlike
-		// DeleteFile, we don't care if the file directory is
-		// corrupt in some way or missing files, all we care is
-		// that we get rid of it
+	if meta.Exhausted() {
+		return nil, fmt.Errorf(`id="%v" was downloaded too often`, id)
+	}
 
-		storageDir := GetConfig().UploadsDirectory
-		baseDir := filepath.Join(storageDir, id)
+	meta.Downloads += 1
 
-		metaPath := filepath.Join(baseDir, "meta.json")
-		os.Remove(metaPath)
+	if err := UpdateFile(meta); err != nil {
+		return nil, errors.Wrapf(err, `cannot count download for id="%v"`, id)
+	}
 
-		storagePath := filepath.Join(baseDir, "storage.bin")
-		os.Remove(storagePath)
+	return meta, nil
+}
 
-		thumbnailPath := filepath.Join(baseDir, "thumbnail.jpg")
-		os.Remove(thumbnailPath)
+// Store changed metadata meta of an existing file and update the index
+// accordingly.
+//
+// Only call this function if you are holding the write lock of the
+// file (see LockFileWrite) or the global write lock.
+func UpdateFile(meta *File) error {
+	if err := GetStorage().PutMeta(meta); err != nil {
+		return err
+	}
 
-		if err := os.Remove(baseDir); err != nil {
-			log.Printf(`could not clean up id="%v"`, id)
-		}
-	}()
+	indexFile(meta)
+	return nil
+}
+
+// Add meta to the index. The file is stored already, so if this fails,
+// we only log it; fsck can fix the index later.
+func indexFile(meta *File) {
+	if err := GetFileIndex().Put(meta); err != nil {
+		log.Printf(`cannot index id="%v", run fsck -repair to fix: %v`, meta.Id, err)
+	}
 }
 
-// Return a local file system path to some file in this file's storage
-// directory.
-func (f *File) pathTo(child string) string {
-	parent := GetConfig().UploadsDirectory
-	return filepath.Join(parent, f.Id, child)
+// Render and store a thumbnail for existing file meta. The thumbnail
+// is stored as blob THUMBNAIL_BLOB.
+func createThumbnailFor(meta *File) error {
+	thumbnail, err := renderThumbnailFor(meta)
+	if err != nil {
+		return err
+	}
+
+	thumbnailSize, err := GetStorage().PutBlob(meta.Id, THUMBNAIL_BLOB, thumbnail)
+	if err != nil {
+		return errors.Wrapf(err, `could not save thumbnail for id="%v"`, meta.Id)
+	}
+
+	meta.ThumbnailSize = &thumbnailSize
+
+	return nil
 }
 
-// Render and store a thumbnail for file meta. The thumbnail will be written
-// to file thumbnail.jpg in directory baseDir.
-func createThumbnailFor(meta *File, baseDir string) error {
+// Render a thumbnail for file meta. Returns the thumbnail encoded as
+// JPEG.
+func renderThumbnailFor(meta *File) (*bytes.Buffer, error) {
 	var (
 		err    error
-		fi     os.FileInfo
-		fp     *os.File
+		fp     Blob
 		source image.Image
 	)
 
 	// open image file
 
-	if fp, err = os.Open(meta.LocalPath()); err != nil {
-		return errors.Wrap(err, "could not open file")
+	if fp, err = OpenFile(meta); err != nil {
+		return nil, errors.Wrap(err, "could not open file")
 	}
 
 	defer fp.Close()
@@ -418,7 +868,7 @@ func createThumbnailFor(meta *File, baseDir string) error {
 	reader := &io.LimitedReader{R: fp, N: MAX_THUMBNAIL_SOURCE_SIZE}
 
 	if source, _, err = image.Decode(reader); err != nil {
-		return errors.Wrap(err, "could not decode image")
+		return nil, errors.Wrap(err, "could not decode image")
 	}
 
 	// check dimensions
@@ -427,7 +877,7 @@ func createThumbnailFor(meta *File, baseDir string) error {
 	sourceHeight := source.Bounds().Max.Y
 
 	if sourceWidth <= 0 || sourceHeight <= 0 {
-		return fmt.Errorf("bad dimensions %v x %v", sourceWidth, sourceHeight)
+		return nil, fmt.Errorf("bad dimensions %v x %v", sourceWidth, sourceHeight)
 	}
 
 	// compute thumbnail dimensions
@@ -444,43 +894,33 @@ func createThumbnailFor(meta *File, baseDir string) error {
 	thumbHeight := int(float64(sourceHeight) * scale)
 
 	if thumbWidth < MIN_THUMBNAIL_DIM || thumbHeight < MIN_THUMBNAIL_DIM {
-		return fmt.Errorf("bad thumbnail dimensions %v x %v", thumbWidth, thumbHeight)
+		return nil, fmt.Errorf("bad thumbnail dimensions %v x %v", thumbWidth, thumbHeight)
 	}
 
-	// compute and save the thumbnail
+	// compute the thumbnail
 
 	thumbnail := imaging.Thumbnail(source, thumbWidth, thumbHeight, imaging.Lanczos)
-	thumbnailPath := filepath.Join(baseDir, "thumbnail.jpg")
-
-	if err = imaging.Save(thumbnail, thumbnailPath); err != nil {
-		return errors.Wrapf(err, `could not save thumbnail to "%v"`, thumbnailPath)
-	}
 
-	// update the thumbnail size
+	var encoded bytes.Buffer
 
-	if fi, err = os.Stat(thumbnailPath); err != nil {
-		return errors.Wrapf(err, `could not stat thumbnail for id="%v"`, meta.Id)
+	if err = imaging.Encode(&encoded, thumbnail, imaging.JPEG); err != nil {
+		return nil, errors.Wrapf(err, `could not encode thumbnail for id="%v"`, meta.Id)
 	}
 
-	thumbnailSize := fi.Size()
-	meta.ThumbnailSize = &thumbnailSize
-
-	// success
-
-	return nil
+	return &encoded, nil
 }
 
 func createShortIdFor(meta *File) error {
-	// keep trying to get an acceptable short id
+	// keep trying to get an acceptable short id; all lengths have to be
+	// within MIN_SHORT_ID_LEN and MAX_SHORT_ID_LEN, otherwise ParseShortId
+	// rejects them
 
-	storageDir := GetConfig().UploadsDirectory
 	lens := []int{3, 3, 4, 4, 4, 5, 5, 5, 5, 6, 7, 8, 9}
 
 	for _, choiceLen := range lens {
 		linkName := createRandomString(choiceLen)
-		link := filepath.Join(storageDir, linkName)
 
-		if err := os.Symlink(meta.Id, link); err == nil {
+		if err := GetStorage().PutLink(linkName, meta.Id); err == nil {
 			meta.ShortId = &linkName
 			return nil
 		}
@@ -508,3 +948,13 @@ func isSymlink(fi os.FileInfo) bool {
 func isDir(fi os.FileInfo) bool {
 	return fi.IsDir()
 }
+
+// Writer that discards everything written to it but counts the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kissen/fmajor/s3/s3test"
+	"github.com/pkg/errors"
+)
+
+// How long a read may take before we consider it blocked.
+const READ_TIMEOUT = 10 * time.Second
+
+// Point the configuration at a new, empty uploads directory. The
+// configuration is a singleton, so all tests in this process share
+// the directory set up first.
+func useTestConfig(tb testing.TB) *Config {
+	configCreator.Do(func() {
+		config = &Config{
+			UploadsDirectory: tb.TempDir(),
+			StagingDirectory: tb.TempDir(),
+			MaxFileSize:      1 << 30,
+		}
+	})
+
+	return config
+}
+
+// Use backend as storage from now on.
+func useTestStorage(tb testing.TB, backend Storage) {
+	useTestConfig(tb)
+
+	storageCreator.Do(func() {})
+	storage = &CheckedStorage{Backend: backend}
+
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	if err := GetFileIndex().Prepare(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := GetSearchIndex().Prepare(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Reader that returns some bytes, then blocks until release is closed.
+type stallingReader struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	sent    bool
+}
+
+func newStallingReader() *stallingReader {
+	return &stallingReader{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (sr *stallingReader) Read(p []byte) (int, error) {
+	if !sr.sent {
+		sr.sent = true
+		return copy(p, "first bytes of a slow upload\n"), nil
+	}
+
+	sr.once.Do(func() { close(sr.started) })
+	<-sr.release
+
+	return 0, io.EOF
+}
+
+// Measure reading a file while another upload is in progress. Uploads
+// only take the global write lock once their contents are in storage,
+// so reads must not wait for them. If they do, the benchmark fails.
+func BenchmarkReadDuringUpload(b *testing.B) {
+	cfg := useTestConfig(b)
+
+	b.Run("directory", func(b *testing.B) {
+		useTestStorage(b, &DirectoryStorage{Root: cfg.UploadsDirectory})
+
+		// the upload stalls while we are reading the request body
+
+		src := newStallingReader()
+		benchmarkReadDuringUpload(b, src, src.started, src.release)
+	})
+
+	b.Run("s3", func(b *testing.B) {
+		srv := s3test.NewServer("bucket")
+		defer srv.Close()
+
+		useTestStorage(b, &S3Storage{Client: srv.Client(), StagingDirectory: b.TempDir()})
+
+		// the upload stalls while sending the contents to S3, which is
+		// the slow part there; copies and metadata go through
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var once sync.Once
+
+		srv.Hook = func(r *http.Request) {
+			isContent := r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") == ""
+			isMeta := strings.Contains(r.URL.Path, "/files/") || strings.HasSuffix(r.URL.Path, ".refs")
+
+			if isContent && !isMeta && r.ContentLength > 1024 {
+				once.Do(func() { close(started) })
+				<-release
+			}
+		}
+
+		// random, so it neither compresses nor exists already from an
+		// earlier run
+
+		bs := make([]byte, 64*1024)
+		rand.Read(bs)
+
+		src := bytes.NewReader(bs)
+		benchmarkReadDuringUpload(b, src, started, release)
+	})
+}
+
+// Upload src in the background and read another file b.N times while
+// that upload is stalled. started is closed once the upload stalls,
+// closing release lets it finish.
+func benchmarkReadDuringUpload(b *testing.B, src io.Reader, started, release chan struct{}) {
+	contents := []byte("contents of a file that is already there\n")
+
+	fm, err := CreateFile(bytes.NewReader(contents), "existing.txt", &CreateOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	uploaded := make(chan error, 1)
+
+	go func() {
+		_, err := CreateFile(src, "upload.bin", &CreateOptions{})
+		uploaded <- err
+	}()
+
+	select {
+	case <-started:
+	case err := <-uploaded:
+		b.Fatalf("upload finished before it stalled: %v", err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		read := make(chan error, 1)
+
+		go func() {
+			read <- readFile(fm.Id, contents)
+		}()
+
+		select {
+		case err := <-read:
+			if err != nil {
+				b.Fatal(err)
+			}
+		case <-time.After(READ_TIMEOUT):
+			close(release)
+			b.Fatalf("read blocked by upload for more than %v", READ_TIMEOUT)
+		}
+	}
+
+	b.StopTimer()
+
+	close(release)
+
+	if err := <-uploaded; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// Read the file with given id the way downloads do and check that it
+// has the expected contents.
+func readFile(id string, expected []byte) error {
+	lease := LockFileRead(id)
+	defer lease.Unlock()
+
+	fm, err := LoadFile(id)
+	if err != nil {
+		return err
+	}
+
+	blob, err := OpenFile(fm)
+	if err != nil {
+		return err
+	}
+
+	defer blob.Close()
+
+	bs, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(bs, expected) {
+		return errors.New("file has unexpected contents")
+	}
+
+	return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/kissen/stringset"
+	"github.com/pkg/errors"
+)
+
+// Checks storage for problems and, if asked to, repairs them. This
+// includes re-hashing the contents of all files, so it can take a while.
+type Checker struct {
+	// Whether to repair the problems we find. Not all problems can
+	// be repaired, e.g. corrupt contents are only reported.
+	Repair bool
+
+	// Where to report problems to, one line per problem.
+	Out io.Writer
+
+	// Number of problems found and repaired so far.
+	Problems int
+	Repaired int
+
+	// Set if we could not load some files for reasons other than
+	// broken metadata. We then do not know which links, content and
+	// index entries are still in use and leave these alone.
+	incomplete bool
+}
+
+// What we found when hashing some content.
+type contentCheck struct {
+	size   int64
+	sha256 string
+	err    error
+}
+
+// Check all stored files, links and content. Problems with storage
+// are reported to c.Out; the returned error is only set if we could
+// not run the check at all.
+//
+// Only call this function if you are holding the global write lock.
+func (c *Checker) Check() error {
+	// load all files; directories with missing or broken metadata
+	// are orphans left behind by crashes, other errors might just be
+	// temporary, so we do not delete anything because of them
+
+	ids, err := GetStorage().List()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]*File)
+
+	for _, id := range ids {
+		fm, err := LoadFile(id)
+
+		if cause := errors.Cause(err); cause == ErrNoMeta || cause == ErrBadMeta {
+			c.report(func() error {
+				return GetStorage().Delete(id)
+			}, `orphaned id="%v": %v`, id, err)
+			continue
+		}
+
+		if err != nil {
+			c.incomplete = true
+			c.report(nil, `cannot load id="%v": %v`, id, err)
+			continue
+		}
+
+		files[id] = fm
+	}
+
+	// check links before the files themselves; this way stale links
+	// are gone before we recreate missing ones
+
+	if err := c.checkLinks(files); err != nil {
+		return err
+	}
+
+	contents := make(map[string]*contentCheck)
+
+	for _, fm := range files {
+		c.checkContents(fm, contents)
+		c.checkThumbnail(fm)
+		c.checkShortId(fm)
+	}
+
+	if err := c.checkContentRefs(files); err != nil {
+		return err
+	}
+
+	// repairs above might have changed files, so check the index last
+
+	return c.checkIndex(files)
+}
+
+// Check that each short link points to a file that knows about it.
+func (c *Checker) checkLinks(files map[string]*File) error {
+	shortIds, err := GetStorage().ListLinks()
+	if err != nil {
+		return err
+	}
+
+	for _, shortId := range shortIds {
+		shortId := shortId
+
+		deleteLink := func() error {
+			return GetStorage().DeleteLink(shortId)
+		}
+
+		id, err := GetStorage().ResolveLink(shortId)
+		if err != nil {
+			c.report(deleteLink, `dangling shortId="%v": %v`, shortId, err)
+			continue
+		}
+
+		fm, ok := files[id]
+		if !ok {
+			c.report(c.unlessIncomplete(deleteLink), `dangling shortId="%v": no file id="%v"`, shortId, id)
+			continue
+		}
+
+		if !fm.HasShortUrl() || *fm.ShortId != shortId {
+			c.report(deleteLink, `stale shortId="%v": not used by id="%v"`, shortId, id)
+		}
+	}
+
+	return nil
+}
+
+// Re-hash the contents of fm and compare them against what fm says.
+// Files can share content, so we only hash each content once and keep
+// track of the results in contents.
+func (c *Checker) checkContents(fm *File, contents map[string]*contentCheck) {
+	if !fm.HasContent() {
+		// files from before content-addressed storage have no hash
+		// to compare against, but we can still check their size
+
+		check := hashContents(OpenFile(fm))
+		c.compareContents(fm, check)
+		return
+	}
+
+	check, ok := contents[fm.ContentHash]
+
+	if !ok {
+		check = hashContents(OpenEncodedFile(fm))
+
+		if check.err == nil && check.sha256 != fm.ContentHash {
+			check.err = fmt.Errorf(`content hash="%v" is corrupt, actual hash="%v"`, fm.ContentHash, check.sha256)
+		}
+
+		if check.err == nil && fm.IsEncoded() {
+			check = hashContents(OpenFile(fm))
+		}
+
+		contents[fm.ContentHash] = check
+	}
+
+	c.compareContents(fm, check)
+}
+
+// Report any mismatch between fm and its hashed contents check.
+func (c *Checker) compareContents(fm *File, check *contentCheck) {
+	if check.err != nil {
+		c.report(nil, `bad contents for id="%v": %v`, fm.Id, check.err)
+		return
+	}
+
+	if check.size != fm.Size {
+		c.report(nil, `bad contents for id="%v": expected size=%v, actual size=%v`, fm.Id, fm.Size, check.size)
+		return
+	}
+
+	if sum, ok := fm.Checksum(); ok && sum != check.sha256 {
+		c.report(nil, `bad contents for id="%v": expected sha256="%v", actual sha256="%v"`, fm.Id, sum, check.sha256)
+	}
+}
+
+// Check that the thumbnail of fm exists if fm says it has one.
+func (c *Checker) checkThumbnail(fm *File) {
+	if !fm.HasThumbnail() {
+		return
+	}
+
+	repair := func() error {
+		// if we cannot create a new thumbnail, we forget about it
+		// so at least we do not link to a missing thumbnail
+
+		if err := createThumbnailFor(fm); err != nil {
+			fm.ThumbnailSize = nil
+		}
+
+		return UpdateFile(fm)
+	}
+
+	size, err := GetStorage().StatBlob(fm.Id, THUMBNAIL_BLOB)
+	if err != nil {
+		c.report(repair, `missing thumbnail for id="%v": %v`, fm.Id, err)
+		return
+	}
+
+	if size != *fm.ThumbnailSize {
+		c.report(repair, `bad thumbnail for id="%v": expected size=%v, actual size=%v`, fm.Id, *fm.ThumbnailSize, size)
+	}
+}
+
+// Check that the short id of fm links to fm.
+func (c *Checker) checkShortId(fm *File) {
+	if !fm.HasShortUrl() {
+		return
+	}
+
+	id, err := GetStorage().ResolveLink(*fm.ShortId)
+
+	if err != nil {
+		c.report(func() error {
+			if err := GetStorage().DeleteLink(*fm.ShortId); err != nil {
+				return err
+			}
+
+			return GetStorage().PutLink(*fm.ShortId, fm.Id)
+		}, `missing shortId="%v" for id="%v": %v`, *fm.ShortId, fm.Id, err)
+
+		return
+	}
+
+	// if the link points somewhere else, we cannot tell which file
+	// should have it
+
+	if id != fm.Id {
+		c.report(nil, `shortId="%v" of id="%v" links to id="%v"`, *fm.ShortId, fm.Id, id)
+	}
+}
+
+// Check that the reference count of all content matches the number of
+// files using it. Content without files is deleted when repairing.
+func (c *Checker) checkContentRefs(files map[string]*File) error {
+	expected := make(map[string]int)
+
+	for _, fm := range files {
+		if fm.HasContent() {
+			expected[fm.ContentHash] += 1
+		}
+	}
+
+	hashes, err := GetStorage().ListContent()
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		hash := hash
+		want := expected[hash]
+
+		refs, err := GetStorage().ContentRefs(hash)
+		if err != nil {
+			c.report(nil, `bad content hash="%v": %v`, hash, err)
+			continue
+		}
+
+		if refs == want {
+			continue
+		}
+
+		repair := c.unlessIncomplete(func() error {
+			return GetStorage().SetContentRefs(hash, want)
+		})
+
+		if want == 0 {
+			c.report(repair, `orphaned content hash="%v"`, hash)
+		} else {
+			c.report(repair, `content hash="%v" has refs=%v, expected refs=%v`, hash, refs, want)
+		}
+	}
+
+	return nil
+}
+
+// Check that the index contains exactly files. All problems are
+// repaired by rebuilding the index once.
+func (c *Checker) checkIndex(files map[string]*File) error {
+	exists, err := GetFileIndex().Exists()
+	if err != nil {
+		return err
+	}
+
+	var rebuilt bool
+	var rebuildErr error
+
+	rebuild := c.unlessIncomplete(func() error {
+		if !rebuilt {
+			rebuilt = true
+			rebuildErr = RebuildIndex()
+		}
+
+		return rebuildErr
+	})
+
+	if !exists {
+		c.report(rebuild, "missing index")
+		return nil
+	}
+
+	indexed, _, err := GetFileIndex().Query(&FileQuery{})
+	if err != nil {
+		return err
+	}
+
+	seen := stringset.New()
+
+	for _, entry := range indexed {
+		seen.Put(entry.Id)
+
+		fm, ok := files[entry.Id]
+		if !ok {
+			c.report(rebuild, `index contains missing id="%v"`, entry.Id)
+			continue
+		}
+
+		if !sameFile(fm, entry) {
+			c.report(rebuild, `index contains outdated id="%v"`, entry.Id)
+		}
+	}
+
+	for id := range files {
+		if !seen.Contains(id) {
+			c.report(rebuild, `index lacks id="%v"`, id)
+		}
+	}
+
+	return nil
+}
+
+// Return whether a and b contain the same metadata.
+func sameFile(a, b *File) bool {
+	abytes, aerr := json.Marshal(a)
+	bbytes, berr := json.Marshal(b)
+
+	return aerr == nil && berr == nil && bytes.Equal(abytes, bbytes)
+}
+
+// Count and print a problem. If we are supposed to repair problems and
+// repair is not nil, call repair and report how that went.
+func (c *Checker) report(repair func() error, format string, args ...interface{}) {
+	c.Problems += 1
+	problem := fmt.Sprintf(format, args...)
+
+	if !c.Repair || repair == nil {
+		fmt.Fprintln(c.Out, problem)
+		return
+	}
+
+	if err := repair(); err != nil {
+		fmt.Fprintf(c.Out, "%v; repair failed: %v\n", problem, err)
+		return
+	}
+
+	c.Repaired += 1
+	fmt.Fprintf(c.Out, "%v; repaired\n", problem)
+}
+
+// Return repair, or nil if repairing depends on knowing all files and
+// we could not load some of them.
+func (c *Checker) unlessIncomplete(repair func() error) func() error {
+	if c.incomplete {
+		return nil
+	}
+
+	return repair
+}
+
+// Read all of blob and return its size and hex encoded SHA-256 hash.
+// Takes the results of an Open function for convenience and closes
+// the blob.
+func hashContents(blob Blob, err error) *contentCheck {
+	if err != nil {
+		return &contentCheck{err: err}
+	}
+
+	defer blob.Close()
+
+	hasher := sha256.New()
+
+	size, err := io.Copy(hasher, blob)
+	if err != nil {
+		return &contentCheck{err: err}
+	}
+
+	return &contentCheck{size: size, sha256: hex.EncodeToString(hasher.Sum(nil))}
+}
@@ -1,21 +1,23 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"mime"
-	"mime/multipart"
 	"net/http"
-	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kissen/fmajor/static"
 	"github.com/kissen/httpstatus"
+	"github.com/pkg/errors"
 )
 
 // GET /
@@ -25,10 +27,30 @@ func GetIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	listing, err := ParseListing(r, INDEX_DEFAULT_PER_PAGE, INDEX_MAX_PER_PAGE)
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	lease := LockRead()
 	defer lease.Unlock()
 
-	fs, err := Files()
+	uploads, err := listing.Query()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// usage is about all files, not just the ones on this page
+
+	usage, err := GetFileIndex().Usage()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	collections, err := Collections()
 	if err != nil {
 		DoError(w, r, http.StatusInternalServerError, err.Error())
 		return
@@ -36,13 +58,115 @@ func GetIndex(w http.ResponseWriter, r *http.Request) {
 
 	lease.Unlock()
 
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
 	vs := map[string]any{
-		"Uploads": fs,
+		"Uploads":     uploads,
+		"Listing":     listing,
+		"Usage":       usage,
+		"User":        user,
+		"Collections": collections,
 	}
 
 	Render(w, r, http.StatusOK, "index.tmpl", vs)
 }
 
+// GET /c/{collection}
+func GetCollection(w http.ResponseWriter, r *http.Request) {
+	if ok, _ := IsAuthorized(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	listing, err := ParseListing(r, INDEX_DEFAULT_PER_PAGE, INDEX_MAX_PER_PAGE)
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	collection, err := LoadCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	listing.InCollection(collection, collection.Url())
+
+	uploads, err := listing.Query()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	collections, err := Collections()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	vs := map[string]any{
+		"Uploads":     uploads,
+		"Listing":     listing,
+		"User":        user,
+		"Collection":  collection,
+		"Collections": collections,
+	}
+
+	Render(w, r, http.StatusOK, "index.tmpl", vs)
+}
+
+// GET /s/{share_token}
+func GetSharedCollection(w http.ResponseWriter, r *http.Request) {
+	listing, err := ParseListing(r, INDEX_DEFAULT_PER_PAGE, INDEX_MAX_PER_PAGE)
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	collection, err := LoadSharedCollection(mux.Vars(r)["share_token"])
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	listing.InSharedCollection(collection)
+
+	uploads, err := listing.Query()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lease.Unlock()
+
+	vs := map[string]any{
+		"Uploads":    uploads,
+		"Listing":    listing,
+		"Collection": collection,
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	Render(w, r, http.StatusOK, "shared.tmpl", vs)
+}
+
 // GET /login
 func GetLogin(w http.ResponseWriter, r *http.Request) {
 	if ok, _ := IsAuthorized(r); ok {
@@ -61,12 +185,13 @@ func PostLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !IsValidPassword(password) {
+	user, ok := Authenticate(r.FormValue("username"), password)
+	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	if err := SetAuthorized(w); err != nil {
+	if err := SetAuthorized(w, user); err != nil {
 		log.Println(err)
 	}
 
@@ -144,30 +269,63 @@ func GetFavicon(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/static/paperclip.svg", http.StatusPermanentRedirect)
 }
 
+// Write headers for serving the contents of fm. Content-Length is
+// not set as it depends on the requested range; ServeBlob takes care
+// of that.
 func WriteHeadersFor(fm *File, w http.ResponseWriter) {
 	contentType := fm.ContentType
 	inline := fm.Inline()
-	size := fm.Size
 	lastModified := fm.UploadedOnUTC
 	etag := fm.Id
 
-	WriteHeadersTo(w, contentType, etag, lastModified, &inline, &size)
+	WriteHeadersTo(w, contentType, etag, lastModified, &inline, nil)
+
+	if fm.HasPassword() {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	if checksum, ok := fm.Checksum(); ok {
+		WriteDigestHeaders(w, checksum)
+	}
 }
 
+// Write headers that allow clients to verify what they downloaded.
+// sha256 is the hex encoded SHA-256 hash of the complete representation
+// we send, that is after applying any Content-Encoding. We send both
+// Repr-Digest (RFC 9530) and the older Digest (RFC 3230) as clients
+// only slowly pick up the former.
+func WriteDigestHeaders(w http.ResponseWriter, sha256 string) {
+	sum, err := hex.DecodeString(sha256)
+	if err != nil {
+		log.Printf(`not writing digest for malformed hash="%v"`, sha256)
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(sum)
+
+	w.Header().Set("Repr-Digest", fmt.Sprintf("sha-256=:%v:", encoded))
+	w.Header().Set("Digest", fmt.Sprintf("sha-256=%v", encoded))
+}
+
+// Write headers for serving the thumbnail of fm. Like WriteHeadersFor,
+// Content-Length is left to ServeBlob.
 func WriteThumbnailHeadersFor(fm *File, w http.ResponseWriter) {
 	contentType := "image/jpeg"
 	inline := true
-	size := fm.ThumbnailSize
 	lastModified := fm.UploadedOnUTC
 	etag := fmt.Sprintf("%v-thumbnail", fm.Id)
 
-	WriteHeadersTo(w, contentType, etag, lastModified, &inline, size)
+	WriteHeadersTo(w, contentType, etag, lastModified, &inline, nil)
+
+	if fm.HasPassword() {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
 }
 
 func WriteHeadersTo(w http.ResponseWriter, contentType, etag string, lastModified time.Time, inline *bool, size *int64) {
 	w.Header().Set("Cache-Control", "max-age=15552000")
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("ETag", etag)
+	w.Header().Set("ETag", strconv.Quote(etag))
 
 	if inline != nil {
 		if *inline {
@@ -201,7 +359,7 @@ func HeadFile(w http.ResponseWriter, r *http.Request) {
 func DoFile(w http.ResponseWriter, r *http.Request, doSendBody bool) {
 	var (
 		err      error
-		fd       *os.File
+		fd       Blob
 		fileId   string
 		fileName string
 		fm       *File
@@ -221,15 +379,16 @@ func DoFile(w http.ResponseWriter, r *http.Request, doSendBody bool) {
 	}
 
 	// Aquire the lease so the underlying file does not get to change while we
-	// are serving it.
+	// are serving it. We hold it until the whole body is sent as backends may
+	// only read the contents while we write them out.
 
-	lease := LockRead()
+	lease := LockFileRead(fileId)
 	defer lease.Unlock()
 
 	// Get meta data struct and write out the respective headers to the client.
 
 	if fm, err = LoadFile(fileId); err != nil {
-		DoError(w, r, http.StatusNotFound, err.Error())
+		DoError(w, r, StatusForLoadError(err), err.Error())
 		return
 	}
 
@@ -238,28 +397,159 @@ func DoFile(w http.ResponseWriter, r *http.Request, doSendBody bool) {
 		return
 	}
 
+	if fm.Expired() {
+		DoError(w, r, http.StatusGone, "file expired")
+		return
+	}
+
+	if fm.Exhausted() {
+		DoError(w, r, http.StatusGone, "file was downloaded too often")
+		return
+	}
+
+	if !IsUnlocked(r, fm) {
+		lease.Unlock()
+		RenderUnlock(w, r, fm, http.StatusUnauthorized, "")
+		return
+	}
+
+	// Downloads of files with a download limit need to be counted, which
+	// requires the write lock of the file.
+
+	if doSendBody && fm.HasDownloadLimit() {
+		lease.Unlock()
+		DoLimitedFile(w, r, fm.Id)
+		return
+	}
+
+	// If the storage backend can serve the file for us, let it do that.
+
+	if doSendBody {
+		if url, ok := PresignedUrlFor(fm, STORAGE_BLOB); ok {
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
 	WriteHeadersFor(fm, w)
 
-	// If we are only serving a HEAD request, we really only have to care about
-	// the headers.
+	// Open actual file and serve it to the client. We also need to do this for
+	// HEAD requests as we need to figure out the size of the response.
 
-	if !doSendBody {
+	if fd, err = OpenFileFor(fm, w, r); err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Open actual file and serve it to the client.
+	defer fd.Close()
+
+	ServeBlob(w, r, fm.UploadedOnUTC, fd)
+}
+
+// Serve the file with given id, which has a download limit, and count
+// the download. Once the file was downloaded as often as allowed, it is
+// deleted.
+func DoLimitedFile(w http.ResponseWriter, r *http.Request, fileId string) {
+	// Count the download before sending out anything so concurrent
+	// requests cannot exceed the limit.
+
+	lease := LockFileWrite(fileId)
+	defer lease.Unlock()
+
+	fm, err := CountDownload(fileId)
+	if err != nil {
+		DoError(w, r, http.StatusGone, err.Error())
+		return
+	}
+
+	WriteHeadersFor(fm, w)
+	w.Header().Set("Cache-Control", "no-store")
 
-	if fd, err = os.Open(fm.LocalPath()); err != nil {
+	fd, err := OpenFileFor(fm, w, r)
+	if err != nil {
 		DoError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	defer fd.Close()
+
+	// Every request counts as a download, so always send out the whole
+	// file, no matter what range or conditions the client asked for.
+
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		r.Header.Del(header)
+	}
+
+	ServeBlob(w, r, fm.UploadedOnUTC, fd)
 	lease.Unlock()
 
-	if _, err := io.Copy(w, fd); err != nil {
-		log.Printf(`serving fileId="%v" failed: %v`, fm.Id, err)
+	// Delete the file if this was the last allowed download.
+
+	if !fm.Exhausted() {
+		return
 	}
+
+	lease = LockWrite()
+	defer lease.Unlock()
+
+	if err := DeleteFile(fm.Id); err != nil {
+		log.Printf(`cannot delete exhausted id="%v": %v`, fm.Id, err)
+		return
+	}
+
+	log.Printf(`deleted exhausted id="%v"`, fm.Id)
+}
+
+// Serve contents of blob to the client. This takes care of conditional
+// requests (If-None-Match, If-Modified-Since, ...) and range requests. Set
+// the ETag header before calling this function, otherwise conditional
+// requests cannot be matched against it.
+//
+// For HEAD requests, only the headers are written.
+func ServeBlob(w http.ResponseWriter, r *http.Request, lastModified time.Time, blob Blob) {
+	// ServeContent leaves out Content-Length if Content-Encoding is set,
+	// but we know the length of encoded blobs just as well. So we hide
+	// the header from ServeContent and only add it once the status is
+	// written.
+
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		w.Header().Del("Content-Encoding")
+		w = &encodingWriter{ResponseWriter: w, encoding: encoding}
+	}
+
+	// We set Content-Type ourselves so the name passed to ServeContent
+	// is never used to guess the content type.
+
+	http.ServeContent(w, r, "", lastModified, blob)
+}
+
+// Open the contents of fm for sending them to the client of r. If
+// the contents are stored encoded and the client accepts that encoding,
+// they are sent as they are stored, otherwise they are decoded on the
+// fly. Call after WriteHeadersFor as this adjusts the headers to match
+// what we send.
+func OpenFileFor(fm *File, w http.ResponseWriter, r *http.Request) (Blob, error) {
+	if !fm.IsEncoded() {
+		return OpenFile(fm)
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if !acceptsEncoding(r, fm.ContentEncoding) {
+		return OpenFile(fm)
+	}
+
+	// different representations need different entity tags, otherwise
+	// caches could mix them up
+
+	etag := fmt.Sprintf("%v-%v", fm.Id, fm.ContentEncoding)
+
+	w.Header().Set("Content-Encoding", fm.ContentEncoding)
+	w.Header().Set("ETag", strconv.Quote(etag))
+
+	WriteDigestHeaders(w, fm.ContentHash)
+
+	return OpenEncodedFile(fm)
 }
 
 // GET /f/{short_id}
@@ -276,8 +566,27 @@ func GetShort(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if meta, err = LoadFile(shortId); err != nil {
-		DoError(w, r, http.StatusNotFound, err.Error())
+	lease := LockRead()
+	defer lease.Unlock()
+
+	if meta, err = LoadShort(shortId); err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	if meta.Expired() {
+		DoError(w, r, http.StatusGone, "file expired")
+		return
+	}
+
+	if meta.Exhausted() {
+		DoError(w, r, http.StatusGone, "file was downloaded too often")
+		return
+	}
+
+	if !IsUnlocked(r, meta) {
+		lease.Unlock()
+		RenderUnlock(w, r, meta, http.StatusUnauthorized, "")
 		return
 	}
 
@@ -291,7 +600,7 @@ func GetThumbnail(w http.ResponseWriter, r *http.Request) {
 }
 
 // HEAD /thumbnails/{file_id}/thumbnail.jpg
-func HeadThumbnails(w http.ResponseWriter, r *http.Request) {
+func HeadThumbnail(w http.ResponseWriter, r *http.Request) {
 	DoThumbnail(w, r, false)
 }
 
@@ -299,7 +608,7 @@ func HeadThumbnails(w http.ResponseWriter, r *http.Request) {
 func DoThumbnail(w http.ResponseWriter, r *http.Request, doSendBody bool) {
 	var (
 		err    error
-		fd     *os.File
+		fd     Blob
 		fileId string
 		fm     *File
 		ok     bool
@@ -310,96 +619,295 @@ func DoThumbnail(w http.ResponseWriter, r *http.Request, doSendBody bool) {
 		return
 	}
 
-	lease := LockRead()
+	lease := LockFileRead(fileId)
 	defer lease.Unlock()
 
 	if fm, err = LoadFile(fileId); err != nil {
-		DoError(w, r, http.StatusNotFound, err.Error())
+		DoError(w, r, StatusForLoadError(err), err.Error())
 		return
 	}
 
-	if !fm.HasThumbnail() {
-		DoError(w, r, http.StatusNotFound, "no thumbnail for given file")
+	if fm.Expired() {
+		DoError(w, r, http.StatusGone, "file expired")
 		return
 	}
 
-	WriteThumbnailHeadersFor(fm, w)
+	if fm.Exhausted() {
+		DoError(w, r, http.StatusGone, "file was downloaded too often")
+		return
+	}
 
-	if !doSendBody {
+	if !IsUnlocked(r, fm) {
+		lease.Unlock()
+		RenderUnlock(w, r, fm, http.StatusUnauthorized, "")
 		return
 	}
 
-	if fd, err = os.Open(fm.LocalThumbnailPath()); err != nil {
+	if !fm.HasThumbnail() {
+		DoError(w, r, http.StatusNotFound, "no thumbnail for given file")
+		return
+	}
+
+	if doSendBody {
+		if url, ok := PresignedUrlFor(fm, THUMBNAIL_BLOB); ok {
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	WriteThumbnailHeadersFor(fm, w)
+
+	if fd, err = OpenThumbnail(fm); err != nil {
 		DoError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	defer fd.Close()
-	lease.Unlock()
 
-	if _, err = io.Copy(w, fd); err != nil {
-		log.Printf(`serving thumbnail for fileId="%v" failed: %v`, fm.Id, err)
-	}
+	ServeBlob(w, r, fm.UploadedOnUTC, fd)
 }
 
 // POST /submit
 func PostSubmit(w http.ResponseWriter, r *http.Request) {
+	// Only allow users to upload.
+
+	if permitted := ErrorIfNotPermitted(w, r, SCOPE_UPLOAD); !permitted {
+		return
+	}
+
+	// Get file contents and register files in bookkeeping.
+
+	results, status, err := ReceiveUploads(w, r)
+	if err != nil {
+		DoError(w, r, status, err.Error())
+		return
+	}
+
+	var failed []string
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", result.Filename, result.Err))
+		}
+	}
+
+	if len(failed) > 0 {
+		DoError(w, r, failedUploadStatus(results), strings.Join(failed, "; "))
+		return
+	}
+
+	// Forward to index page.
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// POST /unlock/{file_id}
+func PostUnlock(w http.ResponseWriter, r *http.Request) {
 	var (
-		createShortId bool
-		err           error
-		file          multipart.File
-		header        *multipart.FileHeader
+		err    error
+		fileId string
+		fm     *File
+		ok     bool
 	)
 
-	// Only allow users to upload.
+	if fileId, ok = mux.Vars(r)["file_id"]; !ok {
+		DoError(w, r, http.StatusBadRequest, "missing file_id")
+		return
+	}
 
-	if authed := ErrorIfNotAuthorized(w, r); !authed {
+	lease := LockFileRead(fileId)
+	defer lease.Unlock()
+
+	if fm, err = LoadFile(fileId); err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
 		return
 	}
 
-	// Get file contents.
+	lease.Unlock()
 
-	r.Body = http.MaxBytesReader(w, r.Body, config.MaxFileSize)
-	r.ParseMultipartForm(16 * 1024 * 1024) // 16 MiB buffer
+	next := localRedirect(r.FormValue("next"), fm.Url())
 
-	if file, header, err = r.FormFile("file"); err != nil {
-		DoError(w, r, http.StatusBadRequest, err.Error())
+	if !fm.IsValidPassword(r.FormValue("password")) {
+		RenderUnlock(w, r, fm, http.StatusForbidden, "wrong password")
+		return
+	}
+
+	if err := SetUnlocked(w, fm); err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	defer file.Close()
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// Render the page that asks visitors for the password of fm. After
+// unlocking, the visitor is sent back to the current URL of r.
+func RenderUnlock(w http.ResponseWriter, r *http.Request, fm *File, status int, message string) {
+	vs := map[string]any{
+		"FileId":  fm.Id,
+		"Next":    r.URL.Path,
+		"Message": message,
+	}
+
+	if r.Method == http.MethodPost {
+		vs["Next"] = r.FormValue("next")
+	}
 
-	// Register file in bookkeeping.
+	w.Header().Set("Cache-Control", "no-store")
+	Render(w, r, status, "unlock.tmpl", vs)
+}
 
-	if value := r.FormValue("create_short_id"); value == "true" {
-		createShortId = true
+// POST /delete
+func PostDelete(w http.ResponseWriter, r *http.Request) {
+	if permitted := ErrorIfNotPermitted(w, r, SCOPE_DELETE); !permitted {
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
 	}
 
+	id := r.FormValue("id")
+
 	lease := LockWrite()
 	defer lease.Unlock()
 
-	if _, err = CreateFile(file, header.Filename, createShortId); err != nil {
-		DoError(w, r, http.StatusInternalServerError, err.Error())
+	fm, err := LoadFile(id)
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
 		return
 	}
 
-	// Forward to index page.
+	if !user.MayDelete(fm) {
+		DoError(w, r, http.StatusForbidden, "only the owner of a file may delete it")
+		return
+	}
+
+	if err := DeleteFile(id); err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// POST /delete
-func PostDelete(w http.ResponseWriter, r *http.Request) {
+// GET /tokens
+func GetTokens(w http.ResponseWriter, r *http.Request) {
 	if authed := ErrorIfNotAuthorized(w, r); !authed {
 		return
 	}
 
+	RenderTokens(w, r, nil)
+}
+
+// POST /tokens
+func PostTokens(w http.ResponseWriter, r *http.Request) {
+	if authed := ErrorIfNotAuthorized(w, r); !authed {
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	r.ParseForm()
+
+	lifetime, err := parseLifetime(r.FormValue("lifetime"))
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, meta, err := CreateToken(user.Name, r.FormValue("name"), r.Form["scope"], lifetime)
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	vs := map[string]any{
+		"NewToken":     token,
+		"NewTokenName": meta.Name,
+	}
+
+	RenderTokens(w, r, vs)
+}
+
+// POST /tokens/revoke
+func PostRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if authed := ErrorIfNotAuthorized(w, r); !authed {
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Users may only revoke their own tokens, except for admins who
+	// may revoke any token.
+
+	tokens, err := Tokens()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	id := r.FormValue("id")
 
+	for _, t := range tokens {
+		if t.Id == id && !user.MayManage(t) {
+			DoError(w, r, http.StatusForbidden, "only the owner of a token may revoke it")
+			return
+		}
+	}
+
+	if err := RevokeToken(id); err != nil {
+		DoError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/tokens", http.StatusFound)
+}
+
+// POST /collections
+func PostCollections(w http.ResponseWriter, r *http.Request) {
+	if permitted := ErrorIfNotPermitted(w, r, SCOPE_UPLOAD); !permitted {
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
 	lease := LockWrite()
 	defer lease.Unlock()
 
-	if err := DeleteFile(id); err != nil {
+	collection, err := CreateCollection(user.Name, strings.TrimSpace(r.FormValue("name")))
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, collection.Url(), http.StatusFound)
+}
+
+// POST /collections/delete
+func PostDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	collection, lease, ok := loadManagedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	defer lease.Unlock()
+
+	if err := DeleteCollection(collection.Name); err != nil {
 		DoError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -407,6 +915,238 @@ func PostDelete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+// POST /collections/share
+func PostShareCollection(w http.ResponseWriter, r *http.Request) {
+	collection, lease, ok := loadManagedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	defer lease.Unlock()
+
+	share := r.FormValue("share") == "true"
+
+	if _, err := ShareCollection(collection.Name, share); err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, collection.Url(), http.StatusFound)
+}
+
+// POST /collections/files
+func PostCollectionFiles(w http.ResponseWriter, r *http.Request) {
+	if authed := ErrorIfNotAuthorized(w, r); !authed {
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	id := r.FormValue("id")
+	name := r.FormValue("collection")
+
+	lease := LockFileWrite(id)
+	defer lease.Unlock()
+
+	fm, err := LoadFile(id)
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	if !user.MayChange(fm) {
+		DoError(w, r, http.StatusForbidden, "only the owner of a file may change its collections")
+		return
+	}
+
+	switch action := r.FormValue("action"); action {
+	case "add":
+		err = AddToCollection(id, name)
+	case "remove":
+		err = RemoveFromCollection(id, name)
+	default:
+		DoError(w, r, http.StatusBadRequest, fmt.Sprintf(`bad action="%v"`, action))
+		return
+	}
+
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return
+	}
+
+	http.Redirect(w, r, localRedirect(r.FormValue("next"), "/"), http.StatusFound)
+}
+
+// Load the collection named in form field "name" of r for changing
+// it. Only its owner and admins may do that. On success, returns the
+// collection and the held global write lock. Otherwise, writes an
+// error to w and returns false.
+func loadManagedCollection(w http.ResponseWriter, r *http.Request) (*Collection, *Unlocker, bool) {
+	if authed := ErrorIfNotAuthorized(w, r); !authed {
+		return nil, nil, false
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return nil, nil, false
+	}
+
+	lease := LockWrite()
+
+	collection, err := LoadCollection(r.FormValue("name"))
+	if err != nil {
+		lease.Unlock()
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return nil, nil, false
+	}
+
+	if !user.MayManageCollection(collection) {
+		lease.Unlock()
+		DoError(w, r, http.StatusForbidden, "only the owner of a collection may change it")
+		return nil, nil, false
+	}
+
+	return collection, lease, true
+}
+
+// Render the token overview page with additional parameters vs.
+func RenderTokens(w http.ResponseWriter, r *http.Request, vs map[string]any) {
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	tokens, err := Tokens()
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var visible []*ApiToken
+
+	for _, t := range tokens {
+		if user.MayManage(t) {
+			visible = append(visible, t)
+		}
+	}
+
+	if vs == nil {
+		vs = make(map[string]any)
+	}
+
+	vs["User"] = user
+	vs["Tokens"] = visible
+	vs["AllScopes"] = AllScopes
+
+	Render(w, r, http.StatusOK, "tokens.tmpl", vs)
+}
+
+// Parse the names of collections as submitted from a form. Each value
+// may contain multiple names separated by commas. Empty names are
+// ignored.
+func parseCollections(values []string) ([]string, error) {
+	var names []string
+
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+
+			if _, err := ParseCollectionName(name); err != nil {
+				return nil, err
+			}
+
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Return next if it is a local path, otherwise fallback. We only
+// redirect to local paths, otherwise we would allow others to abuse
+// us as an open redirect.
+func localRedirect(next, fallback string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return fallback
+	}
+
+	return next
+}
+
+// Parse lifetime as submitted from a form. Empty strings and "never"
+// mean no expiry and are returned as zero.
+func parseLifetime(value string) (time.Duration, error) {
+	if value == "" || value == "never" {
+		return 0, nil
+	}
+
+	lifetime, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if lifetime <= 0 {
+		return 0, fmt.Errorf(`bad lifetime="%v"`, value)
+	}
+
+	return lifetime, nil
+}
+
+// Hash the file password as submitted by the client. An empty value
+// means no password, which is represented as nil.
+func parsePassword(value string) (*string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	hash, err := HashPassword(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hash, nil
+}
+
+// Parse the maximum number of downloads as submitted by the client. An
+// empty value means no limit, which is represented as zero.
+func parseMaxDownloads(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	maxDownloads, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if maxDownloads <= 0 {
+		return 0, fmt.Errorf(`bad max_downloads="%v"`, value)
+	}
+
+	return maxDownloads, nil
+}
+
+// Return the status code to report when loading something based on
+// an id supplied by the client failed. Malformed ids are the fault of
+// the client, everything else we treat as the thing not existing.
+func StatusForLoadError(err error) int {
+	var invalid *InvalidIdError
+
+	if errors.As(err, &invalid) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusNotFound
+}
+
 func DoError(w http.ResponseWriter, r *http.Request, status int, message string) {
 	Error(status, message).ServeHTTP(w, r)
 }
@@ -434,6 +1174,41 @@ func ErrorIfNotAuthorized(w http.ResponseWriter, r *http.Request) (authed bool)
 	return true
 }
 
+// Check whether r is permitted to do what scope describes, either because
+// it contains a valid log in cookie or an API token with that scope.
+//
+// If this request is in fact permitted, this function returns true and
+// does not touch the response writer. Otherwise, write an error to w and
+// return false.
+func ErrorIfNotPermitted(w http.ResponseWriter, r *http.Request, scope string) (permitted bool) {
+	status, message, permitted := checkPermitted(r, scope)
+
+	if !permitted {
+		DoError(w, r, status, message)
+	}
+
+	return permitted
+}
+
+// Check whether r is permitted to do what scope describes. If it is not,
+// also return status code and message to report to the client.
+func checkPermitted(r *http.Request, scope string) (status int, message string, permitted bool) {
+	permitted, err := IsPermitted(r, scope)
+	if err != nil {
+		return http.StatusUnauthorized, err.Error(), false
+	}
+
+	if permitted {
+		return http.StatusOK, "", true
+	}
+
+	if _, ok := BearerToken(r); ok {
+		return http.StatusForbidden, fmt.Sprintf(`token lacks scope="%v"`, scope), false
+	}
+
+	return http.StatusUnauthorized, "not logged in", false
+}
+
 // Return an error handler for status.
 func Error(status int, cause string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Bounds on the length of short ids. See createShortIdFor for the lengths
+// we actually generate.
+const (
+	MIN_SHORT_ID_LEN = 3
+	MAX_SHORT_ID_LEN = 9
+)
+
+// Maximum length of collection names.
+const MAX_COLLECTION_NAME_LEN = 64
+
+// Returned when an id supplied by a client does not look like an id we
+// would have generated. Ids end up in file system paths and object keys,
+// so we never use them without checking them first.
+type InvalidIdError struct {
+	// What kind of id this is, e.g. "id" or "shortId".
+	Kind string
+
+	// The offending id.
+	Id string
+}
+
+func (e *InvalidIdError) Error() string {
+	return fmt.Sprintf(`malformed %v="%v"`, e.Kind, e.Id)
+}
+
+// Check that id is a valid file id, that is a UUID in its canonical
+// lower case form. Returns the id or an *InvalidIdError.
+func ParseFileId(id string) (string, error) {
+	return parseUuid("id", id)
+}
+
+// Check that id is a valid id of an unfinished tus upload. Like file
+// ids, these are UUIDs. Returns the id or an *InvalidIdError.
+func ParseUploadId(id string) (string, error) {
+	return parseUuid("uploadId", id)
+}
+
+// Check that shortId is a valid short id, that is a short alphanumeric
+// string. Returns the short id or an *InvalidIdError.
+func ParseShortId(shortId string) (string, error) {
+	if len(shortId) < MIN_SHORT_ID_LEN || len(shortId) > MAX_SHORT_ID_LEN {
+		return "", &InvalidIdError{Kind: "shortId", Id: shortId}
+	}
+
+	for _, c := range shortId {
+		alnum := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+
+		if !alnum {
+			return "", &InvalidIdError{Kind: "shortId", Id: shortId}
+		}
+	}
+
+	return shortId, nil
+}
+
+// Check that name is a valid collection name, that is a string of
+// letters, digits, dashes, underscores and dots that does not start
+// with a dot. Collection names end up in URLs, so we keep them simple.
+// Returns the name or an *InvalidIdError.
+func ParseCollectionName(name string) (string, error) {
+	if len(name) == 0 || len(name) > MAX_COLLECTION_NAME_LEN || name[0] == '.' {
+		return "", &InvalidIdError{Kind: "collection", Id: name}
+	}
+
+	for _, c := range name {
+		ok := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.'
+
+		if !ok {
+			return "", &InvalidIdError{Kind: "collection", Id: name}
+		}
+	}
+
+	return name, nil
+}
+
+// Check that hash is a valid content hash, that is a hex encoded SHA-256
+// hash in lower case. Returns the hash or an *InvalidIdError.
+func ParseContentHash(hash string) (string, error) {
+	if len(hash) != 2*sha256.Size {
+		return "", &InvalidIdError{Kind: "hash", Id: hash}
+	}
+
+	for _, c := range hash {
+		if !(('0' <= c && c <= '9') || ('a' <= c && c <= 'f')) {
+			return "", &InvalidIdError{Kind: "hash", Id: hash}
+		}
+	}
+
+	return hash, nil
+}
+
+func parseUuid(kind, id string) (string, error) {
+	// uuid.Parse also accepts other notations, e.g. with braces or
+	// an "urn:uuid:" prefix; we only want the form we generate
+
+	parsed, err := uuid.Parse(id)
+	if err != nil || parsed.String() != id {
+		return "", &InvalidIdError{Kind: kind, Id: id}
+	}
+
+	return id, nil
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kissen/stringset"
+	"github.com/pkg/errors"
+)
+
+// Name of the index file inside UploadsDirectory.
+const INDEX_FILE = ".index.log"
+
+// Orders in which FileQuery can return files.
+const (
+	SORT_UPLOADED = "uploaded"
+	SORT_NAME     = "name"
+	SORT_SIZE     = "size"
+	SORT_TYPE     = "type"
+)
+
+// Index of the metadata of all files, so we do not have to load every
+// meta.json for listing files.
+//
+// The index is kept in memory and persisted as a log in INDEX_FILE.
+// Each line of the log is a JSON encoded indexRecord. Changes are
+// appended to the log; before answering queries, we read whatever other
+// processes appended in the meantime. Rebuild replaces the log with a
+// fresh one that only contains the current state.
+//
+// The index is only a cache. Storage is what counts, so the index can
+// always be rebuilt from storage, see RebuildIndex.
+type FileIndex struct {
+	// Path to the log.
+	Path string
+
+	// Protects everything below.
+	mu sync.Mutex
+
+	// The opened log and what we know about it.
+	fd     *os.File
+	fi     os.FileInfo
+	offset int64
+
+	// All indexed files by id.
+	files map[string]*File
+
+	// Storage usage of all indexed files, kept up to date by apply
+	// so we do not have to go through all files for it.
+	usage StorageUsage
+
+	// Number of indexed files using each content and the stored size
+	// we counted for it in usage.PhysicalSize.
+	contents map[string]*indexedContent
+}
+
+// Content used by some indexed files, see FileIndex.contents.
+type indexedContent struct {
+	refs int
+	size int64
+}
+
+// One line in the index log.
+type indexRecord struct {
+	// The file that was created or changed. Nil for deleted files.
+	File *File `json:",omitempty"`
+
+	// Id of the file that was deleted. Empty if File is set.
+	Deleted string `json:",omitempty"`
+}
+
+// Describes which files to return from FileIndex.Query.
+type FileQuery struct {
+	// Only return files uploaded by this user. Empty for all users.
+	Owner string
+
+	// Only return files with this string in their name or path, ignoring
+	// case. Empty for all names.
+	Name string
+
+	// Only return files of this category, one of the CATEGORY_*
+	// constants. Empty for all files.
+	Category string
+
+	// Only return files in the collection with this name. Empty for
+	// all files.
+	Collection string
+
+	// Only return files with these ids. Nil for all files.
+	Ids stringset.StringSet
+
+	// Only return files that can still be downloaded, i.e. files that
+	// are neither expired nor exhausted.
+	Available bool
+
+	// How to sort the files, one of the SORT_* constants. Empty
+	// means SORT_UPLOADED.
+	Sort string
+
+	// Whether to return the files in descending order.
+	Descending bool
+
+	// Skip this many files of the result.
+	Offset int
+
+	// Return at most this many files. Zero means no limit.
+	Limit int
+}
+
+// Global instance of the index. Use GetFileIndex to access this
+// variable.
+var fileIndex *FileIndex
+var fileIndexCreator sync.Once
+
+// Return the singleton instance of the index.
+func GetFileIndex() *FileIndex {
+	fileIndexCreator.Do(func() {
+		fileIndex = &FileIndex{
+			Path: filepath.Join(GetConfig().UploadsDirectory, INDEX_FILE),
+		}
+	})
+
+	return fileIndex
+}
+
+// Return whether the index log exists. If it does not, call Rebuild
+// before using the index.
+func (ix *FileIndex) Exists() (bool, error) {
+	_, err := os.Stat(ix.Path)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrap(err, "cannot check for index")
+	}
+
+	return true, nil
+}
+
+// Build the index from the metadata in storage if it does not exist
+// yet, otherwise compact it. Call this once on startup.
+//
+// Only call this function if you are holding the global write lock.
+func (ix *FileIndex) Prepare() error {
+	exists, err := ix.Exists()
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		log.Printf("building index, this might take a while")
+		return RebuildIndex()
+	}
+
+	return ix.Compact()
+}
+
+// Record that file f was created or changed.
+//
+// Only call this function if you are holding the write lock of the
+// file (see LockFileWrite) or the global write lock.
+func (ix *FileIndex) Put(f *File) error {
+	return ix.append(&indexRecord{File: f})
+}
+
+// Record that the file with given id was deleted.
+//
+// Only call this function if you are holding the global write lock.
+func (ix *FileIndex) Delete(id string) error {
+	return ix.append(&indexRecord{Deleted: id})
+}
+
+// Return the files matching q as well as the number of matching files
+// without taking q.Offset and q.Limit into account. The returned files
+// are copies, so it is safe to modify them.
+//
+// Only call this function if you are holding the global read lock.
+func (ix *FileIndex) Query(q *FileQuery) ([]*File, int, error) {
+	less, err := lessFuncFor(q.Sort)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if err := ix.refresh(); err != nil {
+		return nil, 0, err
+	}
+
+	var matches []*File
+
+	for _, f := range ix.files {
+		if q.matches(f) {
+			matches = append(matches, f)
+		}
+	}
+
+	// ties are broken by id so pages do not overlap
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+
+		if q.Descending {
+			a, b = b, a
+		}
+
+		if less(a, b) {
+			return true
+		}
+
+		if less(b, a) {
+			return false
+		}
+
+		return a.Id < b.Id
+	})
+
+	total := len(matches)
+
+	if q.Offset >= len(matches) {
+		matches = nil
+	} else if q.Offset > 0 {
+		matches = matches[q.Offset:]
+	}
+
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	result := make([]*File, len(matches))
+
+	for i, f := range matches {
+		copied := *f
+		result[i] = &copied
+	}
+
+	return result, total, nil
+}
+
+// Return how much storage all indexed files take up.
+//
+// Only call this function if you are holding the global read lock.
+func (ix *FileIndex) Usage() (*StorageUsage, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if err := ix.refresh(); err != nil {
+		return nil, err
+	}
+
+	usage := ix.usage
+	return &usage, nil
+}
+
+// Replace the index with one that contains exactly files.
+//
+// Only call this function if you are holding the global write lock.
+func (ix *FileIndex) Rebuild(files []*File) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	// write everything to a new log first, then swap it in; other
+	// processes notice the new file on their next refresh
+
+	dir := filepath.Dir(ix.Path)
+
+	tmp, err := ioutil.TempFile(dir, ".index-*")
+	if err != nil {
+		return errors.Wrap(err, "cannot create index")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+
+	for _, f := range files {
+		line, err := encodeIndexRecord(&indexRecord{File: f})
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(line); err != nil {
+			return errors.Wrap(err, "cannot write index")
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "cannot write index")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return errors.Wrap(err, "cannot sync index")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot write index")
+	}
+
+	if err := os.Rename(tmp.Name(), ix.Path); err != nil {
+		return errors.Wrap(err, "cannot replace index")
+	}
+
+	if err := syncDir(dir); err != nil {
+		return errors.Wrap(err, "cannot sync index")
+	}
+
+	return ix.refresh()
+}
+
+// Replace the log with one that only contains the current state. Over
+// time, the log collects lots of records that were overwritten by later
+// records, e.g. each counted download adds one.
+//
+// Only call this function if you are holding the global write lock.
+func (ix *FileIndex) Compact() error {
+	files, _, err := ix.Query(&FileQuery{})
+	if err != nil {
+		return err
+	}
+
+	return ix.Rebuild(files)
+}
+
+// Append record to the log and apply it.
+func (ix *FileIndex) append(record *indexRecord) error {
+	line, err := encodeIndexRecord(record)
+	if err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if err := ix.refresh(); err != nil {
+		return err
+	}
+
+	// the log is opened with O_APPEND, so even if other processes
+	// append at the same time, each line ends up in one piece;
+	// the next refresh then reads our record like any other
+
+	if _, err := ix.fd.Write(line); err != nil {
+		return errors.Wrap(err, "cannot write index")
+	}
+
+	if err := ix.fd.Sync(); err != nil {
+		return errors.Wrap(err, "cannot sync index")
+	}
+
+	return ix.refresh()
+}
+
+// Read everything appended to the log since we last looked. If the log
+// was replaced by Rebuild, start over with the new log. Only call this
+// function if you are holding ix.mu.
+func (ix *FileIndex) refresh() error {
+	fi, err := os.Stat(ix.Path)
+	if err != nil {
+		return errors.Wrap(err, "cannot find index")
+	}
+
+	if ix.fd == nil || !os.SameFile(fi, ix.fi) {
+		if err := ix.reopen(); err != nil {
+			return err
+		}
+	}
+
+	// read up to the last complete line; another process might be
+	// in the middle of appending
+
+	r := bufio.NewReader(io.NewSectionReader(ix.fd, ix.offset, fi.Size()-ix.offset))
+
+	for {
+		line, err := r.ReadBytes('\n')
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "cannot read index")
+		}
+
+		ix.offset += int64(len(line))
+
+		var record indexRecord
+
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("ignoring bad record in index: %v", err)
+			continue
+		}
+
+		ix.apply(&record)
+	}
+}
+
+// Open the log again and forget everything read from the previous
+// log. Only call this function if you are holding ix.mu.
+func (ix *FileIndex) reopen() error {
+	if ix.fd != nil {
+		ix.fd.Close()
+		ix.fd = nil
+	}
+
+	fd, err := os.OpenFile(ix.Path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot open index")
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return errors.Wrap(err, "cannot open index")
+	}
+
+	ix.fd = fd
+	ix.fi = fi
+	ix.offset = 0
+	ix.files = make(map[string]*File)
+	ix.usage = StorageUsage{}
+	ix.contents = make(map[string]*indexedContent)
+
+	return nil
+}
+
+// Apply record to the in-memory index. Only call this function if you
+// are holding ix.mu.
+func (ix *FileIndex) apply(record *indexRecord) {
+	switch {
+	case record.File != nil:
+		ix.remove(record.File.Id)
+		ix.add(record.File)
+	case record.Deleted != "":
+		ix.remove(record.Deleted)
+	}
+}
+
+// Add f to the in-memory index. Files with the same contents only
+// count once towards the physical size. Only call this function if
+// you are holding ix.mu.
+func (ix *FileIndex) add(f *File) {
+	ix.files[f.Id] = f
+
+	ix.usage.Files += 1
+	ix.usage.LogicalSize += f.Size
+
+	if !f.HasContent() {
+		ix.usage.PhysicalSize += f.StoredSize()
+		return
+	}
+
+	c, ok := ix.contents[f.ContentHash]
+	if !ok {
+		c = &indexedContent{size: f.StoredSize()}
+		ix.contents[f.ContentHash] = c
+		ix.usage.PhysicalSize += c.size
+	}
+
+	c.refs += 1
+}
+
+// Remove the file with given id from the in-memory index if it is
+// there. Only call this function if you are holding ix.mu.
+func (ix *FileIndex) remove(id string) {
+	f, ok := ix.files[id]
+	if !ok {
+		return
+	}
+
+	delete(ix.files, id)
+
+	ix.usage.Files -= 1
+	ix.usage.LogicalSize -= f.Size
+
+	if !f.HasContent() {
+		ix.usage.PhysicalSize -= f.StoredSize()
+		return
+	}
+
+	c := ix.contents[f.ContentHash]
+	c.refs -= 1
+
+	if c.refs == 0 {
+		delete(ix.contents, f.ContentHash)
+		ix.usage.PhysicalSize -= c.size
+	}
+}
+
+// Return whether f matches the filters of q.
+func (q *FileQuery) matches(f *File) bool {
+	if q.Owner != "" && f.Owner != q.Owner {
+		return false
+	}
+
+	if q.Name != "" && !strings.Contains(strings.ToLower(f.DisplayPath()), strings.ToLower(q.Name)) {
+		return false
+	}
+
+	if q.Category != "" && f.Category() != q.Category {
+		return false
+	}
+
+	if q.Collection != "" && !f.InCollection(q.Collection) {
+		return false
+	}
+
+	if q.Ids != nil && !q.Ids.Contains(f.Id) {
+		return false
+	}
+
+	if q.Available && (f.Expired() || f.Exhausted()) {
+		return false
+	}
+
+	return true
+}
+
+// Return a function that compares files in the order described by
+// one of the SORT_* constants.
+func lessFuncFor(order string) (func(a, b *File) bool, error) {
+	switch order {
+	case "", SORT_UPLOADED:
+		return func(a, b *File) bool {
+			return a.UploadedOnUTC.Before(b.UploadedOnUTC)
+		}, nil
+
+	case SORT_NAME:
+		return func(a, b *File) bool {
+			return strings.ToLower(a.DisplayPath()) < strings.ToLower(b.DisplayPath())
+		}, nil
+
+	case SORT_SIZE:
+		return func(a, b *File) bool {
+			return a.Size < b.Size
+		}, nil
+
+	case SORT_TYPE:
+		return func(a, b *File) bool {
+			return a.ContentType < b.ContentType
+		}, nil
+
+	default:
+		return nil, fmt.Errorf(`unknown sort order="%v"`, order)
+	}
+}
+
+// Encode record as one line of the log, including the line break.
+func encodeIndexRecord(record *indexRecord) ([]byte, error) {
+	bs, err := json.Marshal(record)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot construct index record")
+	}
+
+	return append(bs, '\n'), nil
+}
+
+// Rebuild the index from the metadata in storage. Files with missing
+// or broken metadata are left out.
+//
+// Only call this function if you are holding the global write lock.
+func RebuildIndex() error {
+	ids, err := GetStorage().List()
+	if err != nil {
+		return err
+	}
+
+	var files []*File
+
+	for _, id := range ids {
+		if f, err := LoadFile(id); err != nil {
+			log.Printf("not indexing: %v", err)
+		} else {
+			files = append(files, f)
+		}
+	}
+
+	return GetFileIndex().Rebuild(files)
+}
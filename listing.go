@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kissen/stringset"
+)
+
+// Number of files per page on the index page if the visitor does not
+// ask for a specific page size.
+const INDEX_DEFAULT_PER_PAGE = 50
+
+// Maximum number of files per page on the index page.
+const INDEX_MAX_PER_PAGE = 500
+
+// Highest page clients may ask for. Larger pages are clamped to this
+// one, so computing the offset of a page cannot overflow. Listings with
+// that many pages are empty in practice anyway.
+const LISTING_MAX_PAGE = 1000000
+
+// Page sizes we offer on the index page.
+var indexPerPageChoices = []int{25, 50, 100, 500}
+
+// Sort orders and categories clients may ask for, see FileQuery.
+var sortOrders = stringset.NewWith(SORT_UPLOADED, SORT_NAME, SORT_SIZE, SORT_TYPE)
+var categories = stringset.NewWith(CATEGORY_IMAGES, CATEGORY_DOCUMENTS, CATEGORY_ARCHIVES)
+
+// Which page of the file listing to show and how. Parsed from the query
+// parameters "page", "per_page", "sort", "order", "category",
+// "collection" and "q".
+type Listing struct {
+	// Page to show, starting at 1.
+	Page int
+
+	// Number of files per page.
+	PerPage int
+
+	// Sort order, one of the SORT_* constants.
+	Sort string
+
+	// Whether to sort in descending order.
+	Descending bool
+
+	// Category to filter by, one of the CATEGORY_* constants. Empty
+	// for all files.
+	Category string
+
+	// Name of the collection to list. Empty for all files.
+	Collection string
+
+	// Search query, see SearchFiles. Empty for all files.
+	Search string
+
+	// Number of files matching Category and Search on all pages. Set
+	// by Query.
+	Total int
+
+	// Page size the client gets if it does not ask for one.
+	defaultPerPage int
+
+	// Path of the page the listing is on.
+	base string
+
+	// Whether to leave out files that cannot be downloaded anymore.
+	onlyAvailable bool
+}
+
+// Parse the listing parameters of r. Missing parameters get default
+// values, invalid parameters result in an error.
+func ParseListing(r *http.Request, defaultPerPage, maxPerPage int) (*Listing, error) {
+	var err error
+
+	l := &Listing{defaultPerPage: defaultPerPage, base: "/"}
+	q := r.URL.Query()
+
+	if l.Page, err = queryInt(r, "page", 1); err != nil || l.Page < 1 {
+		return nil, fmt.Errorf(`bad page="%v"`, q.Get("page"))
+	}
+
+	if l.Page > LISTING_MAX_PAGE {
+		l.Page = LISTING_MAX_PAGE
+	}
+
+	if l.PerPage, err = queryInt(r, "per_page", defaultPerPage); err != nil || l.PerPage < 1 || l.PerPage > maxPerPage {
+		return nil, fmt.Errorf(`bad per_page="%v"`, q.Get("per_page"))
+	}
+
+	if l.Sort = q.Get("sort"); l.Sort == "" {
+		l.Sort = SORT_UPLOADED
+	} else if !sortOrders.Contains(l.Sort) {
+		return nil, fmt.Errorf(`bad sort="%v"`, l.Sort)
+	}
+
+	switch order := q.Get("order"); order {
+	case "":
+		l.Descending = descendingByDefault(l.Sort)
+	case "asc":
+		l.Descending = false
+	case "desc":
+		l.Descending = true
+	default:
+		return nil, fmt.Errorf(`bad order="%v"`, order)
+	}
+
+	if l.Category = q.Get("category"); l.Category != "" && !categories.Contains(l.Category) {
+		return nil, fmt.Errorf(`bad category="%v"`, l.Category)
+	}
+
+	if l.Collection = q.Get("collection"); l.Collection != "" {
+		if _, err := ParseCollectionName(l.Collection); err != nil {
+			return nil, fmt.Errorf(`bad collection="%v"`, l.Collection)
+		}
+	}
+
+	l.Search = strings.TrimSpace(q.Get("q"))
+
+	return l, nil
+}
+
+// Return the files on the current page and set l.Total.
+//
+// Only call this function if you are holding the global read lock.
+func (l *Listing) Query() ([]*File, error) {
+	q := FileQuery{
+		Category:   l.Category,
+		Collection: l.Collection,
+		Sort:       l.Sort,
+		Descending: l.Descending,
+		Offset:     (l.Page - 1) * l.PerPage,
+		Limit:      l.PerPage,
+		Available:  l.onlyAvailable,
+	}
+
+	if l.Search != "" {
+		ids, err := SearchFiles(l.Search)
+		if err != nil {
+			return nil, err
+		}
+
+		// queries without any terms, e.g. only punctuation, match
+		// nothing rather than everything
+
+		if ids == nil {
+			ids = stringset.New()
+		}
+
+		q.Ids = ids
+	}
+
+	files, total, err := GetFileIndex().Query(&q)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Total = total
+	return files, nil
+}
+
+// Only list the files in collection c on the page at base rather than
+// on the index page.
+func (l *Listing) InCollection(c *Collection, base string) {
+	l.Collection = c.Name
+	l.base = base
+}
+
+// Only list the files in shared collection c on its public page. Public
+// pages do not search contents, as that would tell visitors what is in
+// password protected files, and leave out files that cannot be
+// downloaded anymore.
+func (l *Listing) InSharedCollection(c *Collection) {
+	l.InCollection(c, c.SharePath())
+	l.Search = ""
+	l.onlyAvailable = true
+}
+
+// Return the path of the page the listing is on.
+func (l *Listing) Path() string {
+	return l.base
+}
+
+// Return the number of pages. An empty listing still has one page.
+func (l *Listing) Pages() int {
+	if l.Total == 0 {
+		return 1
+	}
+
+	return (l.Total + l.PerPage - 1) / l.PerPage
+}
+
+func (l *Listing) HasPrev() bool {
+	return l.Page > 1
+}
+
+func (l *Listing) HasNext() bool {
+	return l.Page < l.Pages()
+}
+
+// Return the URL of the previous page.
+func (l *Listing) PrevUrl() string {
+	return l.with(func(o *Listing) { o.Page -= 1 })
+}
+
+// Return the URL of the next page.
+func (l *Listing) NextUrl() string {
+	return l.with(func(o *Listing) { o.Page += 1 })
+}
+
+// Return the URL for sorting by sort. If we already sort by sort, the
+// URL reverses the order.
+func (l *Listing) SortUrl(sort string) string {
+	return l.with(func(o *Listing) {
+		if o.Sort == sort {
+			o.Descending = !o.Descending
+		} else {
+			o.Sort = sort
+			o.Descending = descendingByDefault(sort)
+		}
+
+		o.Page = 1
+	})
+}
+
+// Return an arrow that shows the direction we sort in if we sort by
+// sort, otherwise an empty string.
+func (l *Listing) SortIndicator(sort string) string {
+	switch {
+	case l.Sort != sort:
+		return ""
+	case l.Descending:
+		return "↓"
+	default:
+		return "↑"
+	}
+}
+
+// Return the URL for only showing files of category. Pass an empty
+// string for all files.
+func (l *Listing) CategoryUrl(category string) string {
+	return l.with(func(o *Listing) {
+		o.Category = category
+		o.Page = 1
+	})
+}
+
+// Return the URL for listing all files without searching.
+func (l *Listing) ClearSearchUrl() string {
+	return l.with(func(o *Listing) {
+		o.Search = ""
+		o.Page = 1
+	})
+}
+
+// Return the URL for showing perPage files per page.
+func (l *Listing) PerPageUrl(perPage int) string {
+	return l.with(func(o *Listing) {
+		o.PerPage = perPage
+		o.Page = 1
+	})
+}
+
+// Return the page sizes to offer.
+func (l *Listing) PerPageChoices() []int {
+	return indexPerPageChoices
+}
+
+// Return the URL of the listing page for a copy of l changed by change.
+// Parameters with default values are left out.
+func (l *Listing) with(change func(o *Listing)) string {
+	o := *l
+	change(&o)
+
+	q := url.Values{}
+
+	if o.Sort != SORT_UPLOADED {
+		q.Set("sort", o.Sort)
+	}
+
+	if o.Descending != descendingByDefault(o.Sort) {
+		if o.Descending {
+			q.Set("order", "desc")
+		} else {
+			q.Set("order", "asc")
+		}
+	}
+
+	if o.Category != "" {
+		q.Set("category", o.Category)
+	}
+
+	if o.Collection != "" && o.base == "/" {
+		q.Set("collection", o.Collection)
+	}
+
+	if o.Search != "" {
+		q.Set("q", o.Search)
+	}
+
+	if o.PerPage != o.defaultPerPage {
+		q.Set("per_page", strconv.Itoa(o.PerPage))
+	}
+
+	if o.Page != 1 {
+		q.Set("page", strconv.Itoa(o.Page))
+	}
+
+	if len(q) == 0 {
+		return o.base
+	}
+
+	return o.base + "?" + q.Encode()
+}
+
+// Return whether files sorted by sort are shown in descending order
+// unless the client asks otherwise. Newest and biggest files come
+// first, names and types are sorted alphabetically.
+func descendingByDefault(sort string) bool {
+	return sort == SORT_UPLOADED || sort == SORT_SIZE
+}
@@ -1,17 +1,70 @@
 package main
 
-import "sync"
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Name of the lock file inside UploadsDirectory. All instances of
+// fmajor sharing an uploads directory, including the command line
+// tools, lock this file while touching storage.
+const LOCK_FILE = ".lock"
+
+// Directory inside UploadsDirectory with the lock files for per-file
+// locks.
+const LOCKS_DIRECTORY = ".locks"
+
+// Number of per-file locks. Files are mapped to these locks by their
+// id, so now and then two files share a lock. That only means waiting
+// a little longer, but keeps us from creating a lock file per file.
+const FILE_LOCK_STRIPES = 256
 
 // Global lock that will try to ensure that we don't
 // screw up the underlying directory structure on the
 // file system.
 //
-// We do not use file system locks for now, but it
-// probably wouldn't be a bad idea to do so. That would
-// avoid multiple instanced of the software fighting with
-// each other.
+// We lock it for writing when creating or deleting
+// files, links and content, and for reading when
+// listing files. Per-file locks also lock it for
+// reading, so files cannot go away while we work on
+// them.
+//
+// Within this process, global does the work. To keep
+// other processes out, we additionally hold a lock on
+// LOCK_FILE with flock(2), see globalFile.
+//
+// flock(2) lets readers in even while a writer waits,
+// so processes with a steady stream of overlapping
+// readers would keep writers in other processes, e.g.
+// the command line tools, out forever. Writers thus
+// first lock a gate file next to the lock file, which
+// every new reader has to pass, see processFileLock.
 var global sync.RWMutex
 
+// Lock on LOCK_FILE that goes with global.
+var globalFile = processFileLock{name: LOCK_FILE}
+
+// Per-file locks, see LockFileRead and LockFileWrite.
+var fileLocks [FILE_LOCK_STRIPES]fileLock
+
+// Lock for all files whose ids map to it.
+type fileLock struct {
+	mu   sync.RWMutex
+	file processFileLock
+}
+
+func init() {
+	for i := range fileLocks {
+		fileLocks[i].file.name = filepath.Join(LOCKS_DIRECTORY, fmt.Sprintf("%02x", i))
+	}
+}
+
 // Returned by LockRead and LockWrite, call the Unlock
 // method of the Unlocker to release the aquired resource.
 //
@@ -31,26 +84,222 @@ func (u *Unlocker) Unlock() {
 	u.once.Do(u.unlockfunc)
 }
 
-// Lock the global lock for reading. Returns an Unlocker
-// you should use for unlocking once you are done.
+// Lock the global lock for reading. Use this when listing
+// files or resolving short links. Returns an Unlocker you
+// should use for unlocking once you are done.
 func LockRead() *Unlocker {
 	global.RLock()
+	globalFile.lockShared()
 
 	return &Unlocker{
 		unlockfunc: func() {
+			globalFile.unlockShared()
 			global.RUnlock()
 		},
 	}
 }
 
-// Lock the global lock for writing. Returns an Unlocker
+// Lock the global lock for writing. Use this when creating
+// or deleting files, links or content. Returns an Unlocker
 // you should use for unlocking once you are done.
 func LockWrite() *Unlocker {
 	global.Lock()
+	globalFile.lockExclusive()
 
 	return &Unlocker{
 		unlockfunc: func() {
+			globalFile.unlockExclusive()
 			global.Unlock()
 		},
 	}
 }
+
+// Lock the file with given id for reading. Use this when reading
+// the metadata and blobs of a single file. Returns an Unlocker you
+// should use for unlocking once you are done.
+func LockFileRead(id string) *Unlocker {
+	global.RLock()
+	globalFile.lockShared()
+
+	fl := fileLockFor(id)
+	fl.mu.RLock()
+	fl.file.lockShared()
+
+	return &Unlocker{
+		unlockfunc: func() {
+			fl.file.unlockShared()
+			fl.mu.RUnlock()
+			globalFile.unlockShared()
+			global.RUnlock()
+		},
+	}
+}
+
+// Lock the file with given id for writing. Use this when changing
+// the metadata or blobs of a single existing file. Creating and
+// deleting files needs LockWrite instead. Returns an Unlocker you
+// should use for unlocking once you are done.
+func LockFileWrite(id string) *Unlocker {
+	global.RLock()
+	globalFile.lockShared()
+
+	fl := fileLockFor(id)
+	fl.mu.Lock()
+	fl.file.lockExclusive()
+
+	return &Unlocker{
+		unlockfunc: func() {
+			fl.file.unlockExclusive()
+			fl.mu.Unlock()
+			globalFile.unlockShared()
+			global.RUnlock()
+		},
+	}
+}
+
+// Return the per-file lock for the file with given id.
+func fileLockFor(id string) *fileLock {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+
+	return &fileLocks[h.Sum32()%FILE_LOCK_STRIPES]
+}
+
+// Lock the file at path exclusively, creating it if necessary. Blocks
+// until no other process holds a lock on that file. This only keeps
+// other processes out; callers need their own lock to keep out other
+// goroutines.
+func LockFile(path string) (*Unlocker, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, `cannot open lock file path="%v"`, path)
+	}
+
+	if err := flockExclusive(fd); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, `cannot lock path="%v"`, path)
+	}
+
+	return &Unlocker{
+		unlockfunc: func() {
+			funlock(fd)
+			fd.Close()
+		},
+	}, nil
+}
+
+// File lock for use by all goroutines of this process. flock(2) locks
+// belong to the open file, so all readers in this process share the
+// one lock that is taken by the first reader and released by the last.
+// Exclusive locks are only taken while holding the matching mutex for
+// writing, so there are no readers in this process then.
+//
+// Writers hold a lock on the gate file while waiting for the lock file.
+// Readers briefly lock the gate before joining, so once a writer waits,
+// no new readers get in and the readers already in eventually leave.
+type processFileLock struct {
+	// path of the lock file relative to UploadsDirectory; the gate
+	// file has the same path with GATE_SUFFIX appended
+	name string
+
+	opener  sync.Once
+	fd      *os.File
+	gate    *os.File
+	mu      sync.Mutex
+	readers int
+}
+
+// Suffix of the gate file that goes with each lock file.
+const GATE_SUFFIX = ".gate"
+
+// Open the lock and gate files the first time we need them. We can't
+// do anything safely without them, so if it fails, we stop the program.
+func (fl *processFileLock) open() (fd, gate *os.File) {
+	fl.opener.Do(func() {
+		path := filepath.Join(GetConfig().UploadsDirectory, fl.name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			log.Fatalf(`cannot create directory for lock file path="%v": %v`, path, err)
+		}
+
+		fl.fd = openLockFile(path)
+		fl.gate = openLockFile(path + GATE_SUFFIX)
+	})
+
+	return fl.fd, fl.gate
+}
+
+// Open the lock file at path, creating it if necessary. Stops the
+// program on error, see processFileLock.open.
+func openLockFile(path string) *os.File {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf(`cannot open lock file path="%v": %v`, path, err)
+	}
+
+	return fd
+}
+
+func (fl *processFileLock) lockShared() {
+	// wait for writers of other processes that came before us; we
+	// must not hold fl.mu while waiting, readers that are already
+	// in need it for leaving
+
+	_, gate := fl.open()
+
+	if err := flockShared(gate); err != nil {
+		log.Fatalf("cannot lock %v%v: %v", fl.name, GATE_SUFFIX, err)
+	}
+
+	if err := funlock(gate); err != nil {
+		log.Fatalf("cannot unlock %v%v: %v", fl.name, GATE_SUFFIX, err)
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	if fl.readers == 0 {
+		if err := flockShared(fl.fd); err != nil {
+			log.Fatalf("cannot lock %v: %v", fl.name, err)
+		}
+	}
+
+	fl.readers += 1
+}
+
+func (fl *processFileLock) unlockShared() {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	fl.readers -= 1
+
+	if fl.readers == 0 {
+		if err := funlock(fl.fd); err != nil {
+			log.Fatalf("cannot unlock %v: %v", fl.name, err)
+		}
+	}
+}
+
+func (fl *processFileLock) lockExclusive() {
+	fd, gate := fl.open()
+
+	// close the gate while we wait, so no new readers get in
+
+	if err := flockExclusive(gate); err != nil {
+		log.Fatalf("cannot lock %v%v: %v", fl.name, GATE_SUFFIX, err)
+	}
+
+	if err := flockExclusive(fd); err != nil {
+		log.Fatalf("cannot lock %v: %v", fl.name, err)
+	}
+
+	if err := funlock(gate); err != nil {
+		log.Fatalf("cannot unlock %v%v: %v", fl.name, GATE_SUFFIX, err)
+	}
+}
+
+func (fl *processFileLock) unlockExclusive() {
+	if err := funlock(fl.fd); err != nil {
+		log.Fatalf("cannot unlock %v: %v", fl.name, err)
+	}
+}
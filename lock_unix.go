@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Wait for a shared lock on fd.
+func flockShared(fd *os.File) error {
+	return flock(fd, syscall.LOCK_SH)
+}
+
+// Wait for an exclusive lock on fd.
+func flockExclusive(fd *os.File) error {
+	return flock(fd, syscall.LOCK_EX)
+}
+
+// Try to get an exclusive lock on fd. Returns false if somebody else
+// holds a lock on fd.
+func tryFlockExclusive(fd *os.File) (bool, error) {
+	err := flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Release whatever lock we hold on fd.
+func funlock(fd *os.File) error {
+	return flock(fd, syscall.LOCK_UN)
+}
+
+// Call flock(2), retrying if we get interrupted by a signal.
+func flock(fd *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(fd.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
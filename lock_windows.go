@@ -0,0 +1,23 @@
+package main
+
+import "os"
+
+// There is no flock(2) on Windows. Running multiple instances on the
+// same uploads directory is not supported there, so all file locks
+// succeed right away.
+
+func flockShared(fd *os.File) error {
+	return nil
+}
+
+func flockExclusive(fd *os.File) error {
+	return nil
+}
+
+func tryFlockExclusive(fd *os.File) (bool, error) {
+	return true, nil
+}
+
+func funlock(fd *os.File) error {
+	return nil
+}
@@ -1,34 +1,101 @@
 package main
 
 import (
+	"flag"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"os"
 )
 
 func main() {
 	log.SetFlags(log.Lshortfile)
 	log.SetOutput(&LogWriter{})
 
+	flag.Usage = Usage
+	flag.Parse()
+
+	// If the user supplied a command, run that command instead of
+	// the web server. Logs go to stderr so they do not mix with the
+	// output of the command.
+
+	if flag.NArg() > 0 {
+		log.SetOutput(os.Stderr)
+
+		if err := RunCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	Serve()
+}
+
+// Run the web server. Only returns if the server could not be started.
+func Serve() {
 	router := mux.NewRouter()
 	router.HandleFunc("/", GetIndex).Methods("GET")
 	router.HandleFunc("/login", GetLogin).Methods("GET")
 	router.HandleFunc("/login", PostLogin).Methods("POST")
 	router.HandleFunc("/logout", PostLogout).Methods("POST")
 	router.HandleFunc("/favicon.ico", GetFavicon).Methods("GET")
-	router.HandleFunc("/files/{file_id:.+}/{file_name:.+}", GetFile).Methods("GET")
-	router.HandleFunc("/files/{file_id:.+}/{file_name:.+}", HeadFile).Methods("HEAD")
-	router.HandleFunc("/f/{short_id:.+}", GetShort).Methods("GET")
-	router.HandleFunc("/thumbnails/{file_id:.+}/thumbnail.jpg", GetThumbnail).Methods("GET")
-	router.HandleFunc("/thumbnails/{file_id:.+}/thumbnail.jpg", GetThumbnail).Methods("HEAD")
+	router.HandleFunc("/files/{file_id}/{file_name:.+}", GetFile).Methods("GET")
+	router.HandleFunc("/files/{file_id}/{file_name:.+}", HeadFile).Methods("HEAD")
+	router.HandleFunc("/f/{short_id}", GetShort).Methods("GET")
+	router.HandleFunc("/thumbnails/{file_id}/thumbnail.jpg", GetThumbnail).Methods("GET")
+	router.HandleFunc("/thumbnails/{file_id}/thumbnail.jpg", HeadThumbnail).Methods("HEAD")
 	router.HandleFunc("/static/{resource_id:.+}", GetStatic).Methods("GET")
 	router.HandleFunc("/static/{resource_id:.+}", HeadStatic).Methods("HEAD")
 	router.HandleFunc("/submit", PostSubmit).Methods("POST")
 	router.HandleFunc("/delete", PostDelete).Methods("POST")
+	router.HandleFunc("/unlock/{file_id}", PostUnlock).Methods("POST")
+	router.HandleFunc("/c/{collection}", GetCollection).Methods("GET")
+	router.HandleFunc("/s/{share_token}", GetSharedCollection).Methods("GET")
+	router.HandleFunc("/c/{collection}/archive", GetCollectionArchive).Methods("GET")
+	router.HandleFunc("/s/{share_token}/archive", GetSharedCollectionArchive).Methods("GET")
+	router.HandleFunc("/archive", DoArchive).Methods("GET", "POST")
+	router.HandleFunc("/collections", PostCollections).Methods("POST")
+	router.HandleFunc("/collections/delete", PostDeleteCollection).Methods("POST")
+	router.HandleFunc("/collections/share", PostShareCollection).Methods("POST")
+	router.HandleFunc("/collections/files", PostCollectionFiles).Methods("POST")
+	router.HandleFunc("/tokens", GetTokens).Methods("GET")
+	router.HandleFunc("/tokens", PostTokens).Methods("POST")
+	router.HandleFunc("/tokens/revoke", PostRevokeToken).Methods("POST")
+	router.HandleFunc("/tus", OptionsTus).Methods("OPTIONS")
+	router.HandleFunc("/tus", PostTus).Methods("POST")
+	router.HandleFunc("/tus/{upload_id}", HeadTus).Methods("HEAD")
+	router.HandleFunc("/tus/{upload_id}", PatchTus).Methods("PATCH")
+	router.HandleFunc("/tus/{upload_id}", DeleteTus).Methods("DELETE")
+
+	RegisterApi(router)
 
 	router.NotFoundHandler = Error(http.StatusNotFound, "")
 	router.MethodNotAllowedHandler = Error(http.StatusMethodNotAllowed, "")
 
+	// other instances sharing storage with us only write while holding
+	// the write lock or, when spooling uploads, a lock on the spooled
+	// file, so anything else left over is from a crash
+
+	lease := LockWrite()
+
+	if err := GetStorage().Recover(); err != nil {
+		log.Printf("cannot clean up after interrupted writes: %v", err)
+	}
+
+	if err := GetFileIndex().Prepare(); err != nil {
+		log.Fatalf("cannot prepare index: %v", err)
+	}
+
+	if err := GetSearchIndex().Prepare(); err != nil {
+		log.Fatalf("cannot prepare search index: %v", err)
+	}
+
+	lease.Unlock()
+
+	go ReapTusUploads()
+	go ReapExpiredFiles()
+
 	addr := GetConfig().ListenAddress
 	log.Printf(`listening on addr="%v"`, addr)
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How often we look for expired files.
+const EXPIRY_REAP_INTERVAL = time.Minute
+
+// Periodically delete files that have passed their expiry date. Runs
+// forever, so call this function in its own goroutine.
+func ReapExpiredFiles() {
+	for {
+		reapExpiredFilesOnce()
+		time.Sleep(EXPIRY_REAP_INTERVAL)
+	}
+}
+
+func reapExpiredFilesOnce() {
+	// find candidates while only holding the read lock so we do not
+	// block everybody else while going through all files
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	fs, err := Files()
+	if err != nil {
+		log.Printf("cannot list files for expiry: %v", err)
+		return
+	}
+
+	lease.Unlock()
+
+	for _, f := range fs {
+		if f.Expired() || f.Exhausted() {
+			reapExpiredFile(f.Id)
+		}
+	}
+}
+
+// Delete file with given id if it is (still) expired. Exhausted files
+// are usually deleted right after their last download; if that failed,
+// we also clean them up here.
+func reapExpiredFile(id string) {
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	// the file might have been deleted in the meantime; then there
+	// is nothing left to do for us
+
+	f, err := LoadFile(id)
+	if err != nil || !(f.Expired() || f.Exhausted()) {
+		return
+	}
+
+	if err := DeleteFile(id); err != nil {
+		log.Printf(`cannot delete expired id="%v": %v`, id, err)
+		return
+	}
+
+	log.Printf(`deleted expired id="%v"`, id)
+}
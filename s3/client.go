@@ -0,0 +1,559 @@
+// Package s3 implements the small subset of the S3 API fmajor needs
+// to keep uploads in an S3-compatible object storage bucket.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Size of the parts we use for multipart uploads. S3 requires each
+// part except the last one to be at least 5 MiB. Each running upload
+// buffers one part in memory.
+const PART_SIZE = 8 * 1024 * 1024
+
+// Objects up to this size are copied with one request, larger objects
+// are copied in parts of COPY_PART_SIZE bytes. S3 does not copy objects
+// larger than 5 GiB with one request.
+const (
+	MAX_COPY_SIZE  = 5 * 1024 * 1024 * 1024
+	COPY_PART_SIZE = 512 * 1024 * 1024
+)
+
+// Returned when the requested object does not exist.
+var ErrNotFound = errors.New("no such key")
+
+// A client for a single bucket. All requests use path-style URLs,
+// that is "<Endpoint>/<Bucket>/<key>", which works both with AWS and
+// self-hosted implementations.
+type Client struct {
+	// Base URL of the S3 API, for example "https://s3.eu-central-1.amazonaws.com"
+	// or "http://localhost:9000".
+	Endpoint string
+
+	// Region of the bucket, for example "eu-central-1". Self-hosted
+	// implementations usually accept "us-east-1".
+	Region string
+
+	// Name of the bucket.
+	Bucket string
+
+	// Credentials used for signing requests.
+	AccessKey string
+	SecretKey string
+
+	// The HTTP client to use. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Information about a single object as returned by List.
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// Upload everything read from src as object key. Small uploads are
+// sent with one request, larger uploads are split up into multiple
+// parts so we never have to buffer all of src. Returns the number
+// of bytes uploaded.
+func (c *Client) Upload(key string, src io.Reader) (int64, error) {
+	buf := make([]byte, PART_SIZE)
+
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), c.Put(key, bytes.NewReader(buf[:n]), int64(n))
+	}
+
+	if err != nil {
+		return 0, errors.Wrapf(err, `cannot read source for key="%v"`, key)
+	}
+
+	return c.uploadMultipart(key, buf, src)
+}
+
+// Upload exactly size bytes read from body as object key.
+func (c *Client) Put(key string, body io.Reader, size int64) error {
+	r, err := c.newRequest(http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+
+	r.ContentLength = size
+
+	resp, err := c.do(r)
+	if err != nil {
+		return errors.Wrapf(err, `cannot put key="%v"`, key)
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// Open object key for reading starting at byte offset. Returns the
+// body and the remaining number of bytes.
+func (c *Client) Get(key string, offset int64) (io.ReadCloser, int64, error) {
+	r, err := c.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if offset > 0 {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	}
+
+	resp, err := c.do(r)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, `cannot get key="%v"`, key)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Return the size of object key.
+func (c *Client) Stat(key string) (int64, error) {
+	r, err := c.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(r)
+	if err != nil {
+		return 0, errors.Wrapf(err, `cannot stat key="%v"`, key)
+	}
+
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Copy object src to dst. The contents are copied by S3 itself, they
+// never pass through this client.
+func (c *Client) Copy(src, dst string) error {
+	size, err := c.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if size > MAX_COPY_SIZE {
+		return c.copyMultipart(src, dst, size)
+	}
+
+	header := http.Header{"X-Amz-Copy-Source": {c.copySource(src)}}
+
+	r, err := c.newRequestWithHeader(http.MethodPut, dst, nil, nil, header)
+	if err != nil {
+		return err
+	}
+
+	// like completing a multipart upload, copying may report errors
+	// with status 200
+
+	var result struct {
+		XMLName xml.Name
+		Message string
+	}
+
+	if err := c.doXML(r, &result); err != nil {
+		return errors.Wrapf(err, `cannot copy key="%v" to key="%v"`, src, dst)
+	}
+
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf(`cannot copy key="%v" to key="%v": %v`, src, dst, result.Message)
+	}
+
+	return nil
+}
+
+// Delete object key. Deleting an object that does not exist is not
+// an error.
+func (c *Client) Delete(key string) error {
+	r, err := c.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(r)
+	if err != nil {
+		return errors.Wrapf(err, `cannot delete key="%v"`, key)
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// Return all objects with keys starting with prefix.
+func (c *Client) List(prefix string) ([]Object, error) {
+	var (
+		continuation string
+		objects      []Object
+	)
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+
+		r, err := c.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		if err := c.doXML(r, &result); err != nil {
+			return nil, errors.Wrapf(err, `cannot list prefix="%v"`, prefix)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, Object{Key: content.Key, Size: content.Size})
+		}
+
+		if !result.IsTruncated {
+			return objects, nil
+		}
+
+		continuation = result.NextContinuationToken
+	}
+}
+
+// Return an URL anyone can use to download object key until expires
+// has passed. Parameters in response (for example "response-content-type")
+// override the headers S3 sends.
+func (c *Client) PresignGet(key string, expires time.Duration, response url.Values) (string, error) {
+	u, err := c.urlFor(key, response)
+	if err != nil {
+		return "", err
+	}
+
+	c.presign(u, time.Now(), expires)
+	return u.String(), nil
+}
+
+// Upload src as object key in multiple parts. buf contains the
+// first part which was already read from src. It is then reused for
+// reading the following parts.
+func (c *Client) uploadMultipart(key string, buf []byte, src io.Reader) (int64, error) {
+	uploadId, err := c.createMultipartUpload(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		etags []string
+		part  = buf
+		total int64
+	)
+
+	for len(part) > 0 {
+		etag, err := c.uploadPart(key, uploadId, len(etags)+1, part)
+		if err != nil {
+			c.abortMultipartUpload(key, uploadId)
+			return total, err
+		}
+
+		etags = append(etags, etag)
+		total += int64(len(part))
+
+		n, err := io.ReadFull(src, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.abortMultipartUpload(key, uploadId)
+			return total, errors.Wrapf(err, `cannot read source for key="%v"`, key)
+		}
+
+		part = buf[:n]
+	}
+
+	if err := c.completeMultipartUpload(key, uploadId, etags); err != nil {
+		c.abortMultipartUpload(key, uploadId)
+		return total, err
+	}
+
+	return total, nil
+}
+
+// Copy object src of given size to dst in multiple parts.
+func (c *Client) copyMultipart(src, dst string, size int64) error {
+	uploadId, err := c.createMultipartUpload(dst)
+	if err != nil {
+		return err
+	}
+
+	var etags []string
+
+	for offset := int64(0); offset < size; offset += COPY_PART_SIZE {
+		last := offset + COPY_PART_SIZE - 1
+		if last >= size {
+			last = size - 1
+		}
+
+		etag, err := c.uploadPartCopy(src, dst, uploadId, len(etags)+1, offset, last)
+		if err != nil {
+			c.abortMultipartUpload(dst, uploadId)
+			return err
+		}
+
+		etags = append(etags, etag)
+	}
+
+	if err := c.completeMultipartUpload(dst, uploadId, etags); err != nil {
+		c.abortMultipartUpload(dst, uploadId)
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) createMultipartUpload(key string) (string, error) {
+	query := url.Values{"uploads": {""}}
+
+	r, err := c.newRequest(http.MethodPost, key, query, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadId string
+	}
+
+	if err := c.doXML(r, &result); err != nil {
+		return "", errors.Wrapf(err, `cannot create multipart upload for key="%v"`, key)
+	}
+
+	return result.UploadId, nil
+}
+
+func (c *Client) uploadPart(key, uploadId string, partNumber int, part []byte) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadId},
+	}
+
+	r, err := c.newRequest(http.MethodPut, key, query, bytes.NewReader(part))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(r)
+	if err != nil {
+		return "", errors.Wrapf(err, `cannot upload part=%v for key="%v"`, partNumber, key)
+	}
+
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// Copy bytes first to last (inclusive) of object src into part
+// partNumber of the multipart upload for key.
+func (c *Client) uploadPartCopy(src, key, uploadId string, partNumber int, first, last int64) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadId},
+	}
+
+	header := http.Header{
+		"X-Amz-Copy-Source":       {c.copySource(src)},
+		"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%v-%v", first, last)},
+	}
+
+	r, err := c.newRequestWithHeader(http.MethodPut, key, query, nil, header)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		XMLName xml.Name
+		ETag    string
+		Message string
+	}
+
+	if err := c.doXML(r, &result); err != nil {
+		return "", errors.Wrapf(err, `cannot copy part=%v for key="%v"`, partNumber, key)
+	}
+
+	if result.XMLName.Local == "Error" {
+		return "", fmt.Errorf(`cannot copy part=%v for key="%v": %v`, partNumber, key, result.Message)
+	}
+
+	return result.ETag, nil
+}
+
+func (c *Client) completeMultipartUpload(key, uploadId string, etags []string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+
+	for i, etag := range etags {
+		request.Parts = append(request.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+
+	body, err := xml.Marshal(&request)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"uploadId": {uploadId}}
+
+	r, err := c.newRequest(http.MethodPost, key, query, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// S3 may report errors with status 200 in the body of the response,
+	// so we always have to parse it.
+
+	var result struct {
+		XMLName xml.Name
+		Message string
+	}
+
+	if err := c.doXML(r, &result); err != nil {
+		return errors.Wrapf(err, `cannot complete multipart upload for key="%v"`, key)
+	}
+
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf(`cannot complete multipart upload for key="%v": %v`, key, result.Message)
+	}
+
+	return nil
+}
+
+func (c *Client) abortMultipartUpload(key, uploadId string) {
+	query := url.Values{"uploadId": {uploadId}}
+
+	if r, err := c.newRequest(http.MethodDelete, key, query, nil); err == nil {
+		if resp, err := c.do(r); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// Return the URL for object key with additional query.
+func (c *Client) urlFor(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, `bad Endpoint="%v"`, c.Endpoint)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket
+
+	if key != "" {
+		u.Path += "/" + key
+	}
+
+	u.RawPath = canonicalPath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	return u, nil
+}
+
+// Return the value of the X-Amz-Copy-Source header that refers to
+// object key in our bucket.
+func (c *Client) copySource(key string) string {
+	return uriEncode("/"+c.Bucket+"/"+key, false)
+}
+
+// Create a new signed request for object key. If key is empty, the
+// request targets the bucket itself.
+func (c *Client) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	return c.newRequestWithHeader(method, key, query, body, nil)
+}
+
+// Like newRequest, but also set header on the request before signing
+// it.
+func (c *Client) newRequestWithHeader(method, key string, query url.Values, body io.Reader, header http.Header) (*http.Request, error) {
+	u, err := c.urlFor(key, query)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	c.sign(r, time.Now())
+	return r, nil
+}
+
+// Execute request r. Responses that indicate failure are turned
+// into errors.
+func (c *Client) do(r *http.Request) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var result struct {
+		Code    string
+		Message string
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if err := xml.Unmarshal(body, &result); err != nil || result.Code == "" {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	return nil, fmt.Errorf("unexpected status %v: %v: %v", resp.Status, result.Code, result.Message)
+}
+
+// Execute request r and parse the XML response into v.
+func (c *Client) doXML(r *http.Request, v any) error {
+	resp, err := c.do(r)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "cannot parse response")
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package s3_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kissen/fmajor/s3"
+	"github.com/kissen/fmajor/s3/s3test"
+	"github.com/pkg/errors"
+)
+
+func TestPutGetStatDelete(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	c := srv.Client()
+	contents := "contents of a key with spaces and $pecial characters"
+	key := "dir/a key with $pecial characters"
+
+	if err := c.Put(key, strings.NewReader(contents), int64(len(contents))); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, ok := srv.Object(key); !ok || string(bs) != contents {
+		t.Fatalf("server has contents=%q, expected contents=%q", bs, contents)
+	}
+
+	if size, err := c.Stat(key); err != nil || size != int64(len(contents)) {
+		t.Fatalf("got size=%v err=%v, expected size=%v", size, err, len(contents))
+	}
+
+	for _, offset := range []int64{0, 9} {
+		body, size, err := c.Get(key, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bs, err := ioutil.ReadAll(body)
+		body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := contents[offset:]; string(bs) != expected || size != int64(len(expected)) {
+			t.Errorf("got contents=%q size=%v at offset=%v, expected contents=%q", bs, size, offset, expected)
+		}
+	}
+
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Stat(key); errors.Cause(err) != s3.ErrNotFound {
+		t.Errorf("got err=%v from Stat after Delete, expected ErrNotFound", err)
+	}
+
+	if _, _, err := c.Get(key, 0); errors.Cause(err) != s3.ErrNotFound {
+		t.Errorf("got err=%v from Get after Delete, expected ErrNotFound", err)
+	}
+
+	// deleting again is fine
+
+	if err := c.Delete(key); err != nil {
+		t.Errorf("got err=%v from deleting missing key", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	c := srv.Client()
+
+	// sizes that fit into one request, fill exactly one part and
+	// need multiple parts
+
+	for _, size := range []int{0, 1000, s3.PART_SIZE, 2*s3.PART_SIZE + 123} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			contents := make([]byte, size)
+			rand.Read(contents)
+
+			key := fmt.Sprintf("upload-%v", size)
+
+			n, err := c.Upload(key, bytes.NewReader(contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != int64(size) {
+				t.Errorf("uploaded %v bytes, expected %v bytes", n, size)
+			}
+
+			if bs, ok := srv.Object(key); !ok || !bytes.Equal(bs, contents) {
+				t.Errorf("server has %v bytes with different contents", len(bs))
+			}
+
+			if pending := srv.PendingUploads(); pending != 0 {
+				t.Errorf("%v multipart uploads left pending", pending)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	// small pages, so listing has to follow continuation tokens
+
+	srv.MaxKeys = 2
+	c := srv.Client()
+
+	var expected []s3.Object
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("files/%v", i)
+		contents := strings.Repeat("x", i)
+
+		if err := c.Put(key, strings.NewReader(contents), int64(len(contents))); err != nil {
+			t.Fatal(err)
+		}
+
+		expected = append(expected, s3.Object{Key: key, Size: int64(i)})
+	}
+
+	if err := c.Put("other", strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := c.List("files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("got objects=%v, expected objects=%v", objects, expected)
+	}
+
+	if objects, err := c.List("missing/"); err != nil || len(objects) != 0 {
+		t.Errorf("got objects=%v err=%v for missing prefix", objects, err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	c := srv.Client()
+	contents := "contents to copy"
+
+	if err := c.Put("src key", strings.NewReader(contents), int64(len(contents))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Copy("src key", "dst key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, ok := srv.Object("dst key"); !ok || string(bs) != contents {
+		t.Errorf("copy has contents=%q, expected contents=%q", bs, contents)
+	}
+
+	if err := c.Copy("missing", "dst key"); errors.Cause(err) != s3.ErrNotFound {
+		t.Errorf("got err=%v from copying missing key, expected ErrNotFound", err)
+	}
+}
+
+func TestPresignGet(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	c := srv.Client()
+	contents := "contents to download"
+
+	if err := c.Put("file", strings.NewReader(contents), int64(len(contents))); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := c.PresignGet("file", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(bs) != contents {
+		t.Errorf("got status=%v contents=%q, expected contents=%q", resp.StatusCode, bs, contents)
+	}
+}
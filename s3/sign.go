@@ -0,0 +1,183 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// We never hash request bodies; both AWS and other S3 implementations
+// allow this for authenticated requests.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Timestamp formats used by AWS Signature Version 4.
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+// Sign request r with AWS Signature Version 4 by setting the
+// Authorization header and friends. Besides the host, all headers
+// starting with "X-Amz-" are signed, as S3 requires.
+func (c *Client) sign(r *http.Request, now time.Time) {
+	now = now.UTC()
+
+	r.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	names := []string{"host"}
+
+	for name := range r.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range names {
+		value := r.URL.Host
+
+		if name != "host" {
+			value = strings.TrimSpace(r.Header.Get(name))
+		}
+
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	signature := c.signature(r.Method, r.URL, canonicalHeaders.String(), signedHeaders, unsignedPayload, now)
+
+	authorization := fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		c.AccessKey, c.scope(now), signedHeaders, signature,
+	)
+
+	r.Header.Set("Authorization", authorization)
+}
+
+// Add query parameters to u that allow anyone in possession of u to
+// issue a GET request until expires has passed.
+func (c *Client) presign(u *url.URL, now time.Time, expires time.Duration) {
+	now = now.UTC()
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", c.AccessKey+"/"+c.scope(now))
+	query.Set("X-Amz-Date", now.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(query)
+
+	canonicalHeaders := "host:" + u.Host + "\n"
+	signature := c.signature(http.MethodGet, u, canonicalHeaders, "host", unsignedPayload, now)
+
+	u.RawQuery += "&X-Amz-Signature=" + signature
+}
+
+// Return the hex encoded signature for a request. payloadHash is the
+// hex encoded SHA-256 hash of the body or unsignedPayload.
+func (c *Client) signature(method string, u *url.URL, canonicalHeaders, signedHeaders, payloadHash string, now time.Time) string {
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalPath(u.Path),
+		canonicalQuery(u.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(amzDateFormat),
+		c.scope(now),
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+c.SecretKey), now.Format(amzShortFormat))
+	key = hmacSha256(key, c.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+// Return the credential scope for signatures created at now.
+func (c *Client) scope(now time.Time) string {
+	return fmt.Sprintf("%v/%v/s3/aws4_request", now.Format(amzShortFormat), c.Region)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encode path p the way AWS wants it for signatures: every byte except
+// unreserved characters and the slash is percent encoded.
+func canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	return uriEncode(p, false)
+}
+
+// Encode query q the way AWS wants it for signatures: keys are sorted
+// and both keys and values are strictly percent encoded.
+func canonicalQuery(q url.Values) string {
+	var keys []string
+
+	for key := range q {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var pairs []string
+
+	for _, key := range keys {
+		values := append([]string(nil), q[key]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// Percent encode s as described in the AWS documentation. If
+// encodeSlash is false, slashes are left as they are.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
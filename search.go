@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kissen/stringset"
+	"github.com/pkg/errors"
+)
+
+// Name of the directory inside UploadsDirectory that contains the
+// search index.
+const SEARCH_DIRECTORY = ".search"
+
+// Number of files the postings of the search index are spread over.
+const SEARCH_SHARDS = 256
+
+// How much text at the start of each file we index. Later text cannot
+// be found by searching.
+const SEARCH_MAX_TEXT = 4 * 1024 * 1024
+
+// Maximum number of different terms we index per file.
+const SEARCH_MAX_TERMS = 20000
+
+// Terms shorter or longer than this many bytes are not indexed.
+const (
+	SEARCH_MIN_TERM_LEN = 2
+	SEARCH_MAX_TERM_LEN = 64
+)
+
+// Contains the mime types besides text/* of files whose contents we
+// index for searching.
+var searchableMimeTypes stringset.StringSet
+
+// Contains extensions of files whose contents we index even if their
+// content type is not telling, e.g. because the system does not know
+// about Markdown.
+var searchableExtensions stringset.StringSet
+
+func init() {
+	searchableMimeTypes = stringset.NewWith(
+		"application/json", "application/ld+json", "application/x-ndjson",
+	)
+
+	searchableExtensions = stringset.NewWith(
+		".txt", ".md", ".markdown", ".csv", ".json", ".log",
+	)
+}
+
+// Inverted index of the terms in the contents of text files, so we
+// can search them without reading all files.
+//
+// Each term is assigned to one of SEARCH_SHARDS posting files. Each
+// line of a posting file is either "<term> <id>", meaning the file with
+// that id contains that term, or "- <id>", meaning that the file with
+// that id was deleted. Additionally, for each indexed file, we keep a
+// list of posting files it was added to, so we know where to mark it
+// deleted. Compact removes deleted files for good.
+//
+// Like FileIndex, the search index is only a cache and can be rebuilt
+// from storage, see RebuildSearchIndex.
+type SearchIndex struct {
+	// Directory with all files of the index.
+	Dir string
+}
+
+// Global instance of the search index. Use GetSearchIndex to access
+// this variable.
+var searchIndex *SearchIndex
+var searchIndexCreator sync.Once
+
+// Return the singleton instance of the search index.
+func GetSearchIndex() *SearchIndex {
+	searchIndexCreator.Do(func() {
+		searchIndex = &SearchIndex{
+			Dir: filepath.Join(GetConfig().UploadsDirectory, SEARCH_DIRECTORY),
+		}
+	})
+
+	return searchIndex
+}
+
+// Build the search index from storage if it does not exist yet,
+// otherwise compact it. Call this once on startup after preparing
+// the FileIndex.
+//
+// Only call this function if you are holding the global write lock.
+func (si *SearchIndex) Prepare() error {
+	if _, err := os.Stat(si.Dir); os.IsNotExist(err) {
+		log.Printf("building search index, this might take a while")
+		return RebuildSearchIndex()
+	} else if err != nil {
+		return errors.Wrap(err, "cannot check for search index")
+	}
+
+	return si.Compact()
+}
+
+// Record that the file with given id contains terms.
+//
+// Only call this function if you are holding the global write lock.
+func (si *SearchIndex) Add(id string, terms []string) error {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	// group the terms by posting file so we only open each one once
+
+	lines := make(map[int]*bytes.Buffer)
+
+	for _, term := range terms {
+		shard := searchShardFor(term)
+
+		if lines[shard] == nil {
+			lines[shard] = &bytes.Buffer{}
+		}
+
+		fmt.Fprintf(lines[shard], "%v %v\n", term, id)
+	}
+
+	var shards []string
+
+	for shard, buf := range lines {
+		if err := si.appendTo(si.postingsPath(shard), buf.Bytes()); err != nil {
+			return err
+		}
+
+		shards = append(shards, strconv.Itoa(shard))
+	}
+
+	sort.Strings(shards)
+	list := strings.Join(shards, "\n") + "\n"
+
+	if err := os.MkdirAll(filepath.Dir(si.filePath(id)), 0700); err != nil {
+		return errors.Wrap(err, "cannot create search index")
+	}
+
+	if err := ioutil.WriteFile(si.filePath(id), []byte(list), 0600); err != nil {
+		return errors.Wrapf(err, `cannot index id="%v" for searching`, id)
+	}
+
+	return nil
+}
+
+// Remove the file with given id from the index. Files that were never
+// indexed are ignored.
+//
+// Only call this function if you are holding the global write lock.
+func (si *SearchIndex) Remove(id string) error {
+	bs, err := ioutil.ReadFile(si.filePath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, `cannot remove id="%v" from search index`, id)
+	}
+
+	tombstone := []byte(fmt.Sprintf("- %v\n", id))
+
+	for _, field := range strings.Fields(string(bs)) {
+		shard, err := strconv.Atoi(field)
+		if err != nil || shard < 0 || shard >= SEARCH_SHARDS {
+			continue
+		}
+
+		if err := si.appendTo(si.postingsPath(shard), tombstone); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(si.filePath(id)); err != nil {
+		return errors.Wrapf(err, `cannot remove id="%v" from search index`, id)
+	}
+
+	return nil
+}
+
+// Return the ids of all files that contain term.
+//
+// Only call this function if you are holding the global read lock.
+func (si *SearchIndex) Lookup(term string) (stringset.StringSet, error) {
+	ids := stringset.New()
+	deleted := stringset.New()
+
+	err := si.scan(searchShardFor(term), func(t, id string) {
+		switch t {
+		case "-":
+			deleted.Put(id)
+		case term:
+			ids.Put(id)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range deleted.Strings() {
+		ids.Remove(id)
+	}
+
+	return ids, nil
+}
+
+// Rewrite all posting files without deleted files.
+//
+// Only call this function if you are holding the global write lock.
+func (si *SearchIndex) Compact() error {
+	for shard := 0; shard < SEARCH_SHARDS; shard++ {
+		if err := si.compactShard(shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rewrite posting file shard without deleted files.
+func (si *SearchIndex) compactShard(shard int) error {
+	var lines [][2]string
+	deleted := stringset.New()
+
+	err := si.scan(shard, func(term, id string) {
+		if term == "-" {
+			deleted.Put(id)
+		} else {
+			lines = append(lines, [2]string{term, id})
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if deleted.Len() == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	for _, line := range lines {
+		if !deleted.Contains(line[1]) {
+			fmt.Fprintf(&buf, "%v %v\n", line[0], line[1])
+		}
+	}
+
+	path := si.postingsPath(shard)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".compact-*")
+	if err != nil {
+		return errors.Wrap(err, "cannot compact search index")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "cannot compact search index")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot compact search index")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "cannot compact search index")
+	}
+
+	return nil
+}
+
+// Call f with term and id of each line in posting file shard.
+func (si *SearchIndex) scan(shard int, f func(term, id string)) error {
+	fd, err := os.Open(si.postingsPath(shard))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "cannot read search index")
+	}
+
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		if term, id, ok := strings.Cut(scanner.Text(), " "); ok {
+			f(term, id)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "cannot read search index")
+	}
+
+	return nil
+}
+
+// Append bs to the file at path, creating it and its directory if
+// necessary.
+func (si *SearchIndex) appendTo(path string, bs []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "cannot create search index")
+	}
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot write search index")
+	}
+
+	defer fd.Close()
+
+	if _, err := fd.Write(bs); err != nil {
+		return errors.Wrap(err, "cannot write search index")
+	}
+
+	return fd.Close()
+}
+
+func (si *SearchIndex) postingsPath(shard int) string {
+	return filepath.Join(si.Dir, "postings", fmt.Sprintf("%02x", shard))
+}
+
+func (si *SearchIndex) filePath(id string) string {
+	return filepath.Join(si.Dir, "files", id)
+}
+
+// Return the ids of all files that match query. A file matches if each
+// term of query is contained in its name or is one of the terms in its
+// contents. Returns nil if query contains no terms at all.
+//
+// Only call this function if you are holding the global read lock.
+func SearchFiles(query string) (stringset.StringSet, error) {
+	var matches stringset.StringSet
+
+	for _, term := range searchTerms(query) {
+		ids, err := GetSearchIndex().Lookup(term)
+		if err != nil {
+			return nil, err
+		}
+
+		named, _, err := GetFileIndex().Query(&FileQuery{Name: term})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range named {
+			ids.Put(f.Id)
+		}
+
+		if matches == nil {
+			matches = ids
+			continue
+		}
+
+		for _, id := range matches.Strings() {
+			if !ids.Contains(id) {
+				matches.Remove(id)
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// Rebuild the search index from the contents in storage.
+//
+// Only call this function if you are holding the global write lock.
+func RebuildSearchIndex() error {
+	si := GetSearchIndex()
+
+	if err := os.RemoveAll(si.Dir); err != nil {
+		return errors.Wrap(err, "cannot remove search index")
+	}
+
+	if err := os.MkdirAll(si.Dir, 0700); err != nil {
+		return errors.Wrap(err, "cannot create search index")
+	}
+
+	files, err := Files()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !isSearchable(f.ContentType, f.Name) {
+			continue
+		}
+
+		terms, err := extractTerms(f)
+		if err != nil {
+			log.Printf(`not indexing id="%v" for searching: %v`, f.Id, err)
+			continue
+		}
+
+		if err := si.Add(f.Id, terms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read the contents of f and return the terms in them.
+func extractTerms(f *File) ([]string, error) {
+	blob, err := OpenFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	defer blob.Close()
+
+	tc := &termCollector{}
+
+	if _, err := bufio.NewReader(blob).WriteTo(tc); err != nil {
+		return nil, err
+	}
+
+	return tc.Terms(), nil
+}
+
+// Return whether we index the contents of files with given content
+// type and name.
+func isSearchable(contentType, filename string) bool {
+	if searchableExtensions.Contains(strings.ToLower(path.Ext(filename))) {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || searchableMimeTypes.Contains(mediaType)
+}
+
+// Return the terms in query as we would index them.
+func searchTerms(query string) []string {
+	tc := &termCollector{}
+	tc.Write([]byte(query))
+
+	return tc.Terms()
+}
+
+// Return the posting file term belongs in.
+func searchShardFor(term string) int {
+	h := fnv.New32a()
+	h.Write([]byte(term))
+
+	return int(h.Sum32() % SEARCH_SHARDS)
+}
+
+// Writer that splits everything written to it into lower case terms
+// made up of letters and digits. Stops collecting after SEARCH_MAX_TEXT
+// bytes or SEARCH_MAX_TERMS terms, but always accepts all writes.
+type termCollector struct {
+	terms   stringset.StringSet
+	current strings.Builder
+	partial []byte
+	seen    int
+}
+
+func (tc *termCollector) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if remaining := SEARCH_MAX_TEXT - tc.seen; len(p) > remaining {
+		p = p[:remaining]
+	}
+
+	tc.seen += len(p)
+
+	// runes can be split across writes, so we keep incomplete runes
+	// around for the next write
+
+	data := append(tc.partial, p...)
+	tc.partial = nil
+
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			tc.partial = append([]byte{}, data...)
+			break
+		}
+
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			tc.current.WriteRune(unicode.ToLower(r))
+		} else {
+			tc.endTerm()
+		}
+	}
+
+	return n, nil
+}
+
+// Return all collected terms, sorted.
+func (tc *termCollector) Terms() []string {
+	tc.endTerm()
+
+	if tc.terms == nil {
+		return nil
+	}
+
+	terms := tc.terms.Strings()
+	sort.Strings(terms)
+
+	return terms
+}
+
+// Add the current term, if any, to the collected terms.
+func (tc *termCollector) endTerm() {
+	term := tc.current.String()
+	tc.current.Reset()
+
+	if len(term) < SEARCH_MIN_TERM_LEN || len(term) > SEARCH_MAX_TERM_LEN {
+		return
+	}
+
+	if tc.terms == nil {
+		tc.terms = stringset.New()
+	}
+
+	if tc.terms.Len() < SEARCH_MAX_TERMS {
+		tc.terms.Put(term)
+	}
+}
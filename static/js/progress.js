@@ -1,3 +1,16 @@
+// Uploads are sent with the tus protocol for resumable uploads. We
+// send the file in chunks; if a chunk fails, we ask the server how
+// much it already got and continue from there.
+
+const TUS_VERSION = '1.0.0'
+
+// Size of the individual PATCH requests.
+const CHUNK_SIZE = 8 * 1024 * 1024
+
+// How often we retry a failed chunk before giving up, and how long
+// to wait in between tries (in milliseconds).
+const RETRY_DELAYS = [1000, 3000, 5000, 10000, 20000, 30000]
+
 class State {
 	static Ready = new State('Ready')
 	static Downloading = new State('Downloading')
@@ -42,77 +55,244 @@ class State {
 	}
 }
 
-function uploadButtonClicked() {
+async function uploadButtonClicked() {
 	// Check state. We only allow one update at a time for now.
 
 	if (State.get() !== State.Ready) {
 		return
 	}
 
-	// Get the file.
+	// Get the files, either picked one by one or as a folder.
 
-	const files = document.getElementById('file').files
-	const file = files[0]
+	const files = [
+		...document.getElementById('file').files,
+		...document.getElementById('folder').files,
+	]
 
-	if (file === undefined) {
+	if (files.length === 0) {
 		return
 	}
 
 	// Get file parameters
 
 	const createShortIdCheckbox = document.getElementById('create_short_id')
+	const lifetimeSelect = document.getElementById('lifetime')
+	const maxDownloadsCheckbox = document.getElementById('max_downloads')
+	const passwordInput = document.getElementById('file_password')
+	const collectionSelect = document.getElementById('collection')
+
+	const options = {
+		create_short_id: String(createShortIdCheckbox.checked),
+		lifetime: lifetimeSelect.value,
+	}
 
-	// Set up the form.
+	if (maxDownloadsCheckbox.checked) {
+		options.max_downloads = maxDownloadsCheckbox.value
+	}
 
-	const form = new FormData()
+	if (passwordInput.value) {
+		options.password = passwordInput.value
+	}
 
-	form.append('file', file)
-	form.append('create_short_id', createShortIdCheckbox.checked)
+	if (collectionSelect !== null && collectionSelect.value) {
+		options.collection = collectionSelect.value
+	}
 
-	// Set up the request.
+	// Update global state.
 
-	const tx = new XMLHttpRequest()
+	State.set(State.Downloading)
+	setProgressTextTo('Uploading... 0%')
 
-	tx.upload.addEventListener('abort', handleUploadAbort)
-	tx.upload.addEventListener('error', handleUploadError)
-	tx.upload.addEventListener('load', handleUploadLoad)
-	tx.upload.addEventListener('progress', handleUploadProgress)
+	// Upload the files one after the other. Files in a folder keep
+	// their path relative to the folder.
 
-	// Start the request. The event handlers take care of the rest.
+	for (const [i, file] of files.entries()) {
+		const metadata = {...options, filename: file.name}
 
-	tx.open('POST', '/submit')
-	tx.send(form)
+		if (file.webkitRelativePath) {
+			metadata.path = file.webkitRelativePath
+		}
 
-	// Update global state.
+		window.uploadLabel = files.length > 1 ? `file ${i + 1} of ${files.length}, ` : ''
 
-	State.set(State.Downloading)
-}
+		try {
+			await upload(file, metadata)
+		} catch (e) {
+			setProgressTextTo(`Uploading ${file.name} failed: ${e.message}`)
+			State.set(State.Done)
+			return
+		}
+	}
 
-function handleUploadAbort(e) {
+	location.reload(true)
 	State.set(State.Done)
 }
 
-function handleUploadError(e) {
-	setProgressTextTo('Upload failed.')
-	State.set(State.Done)
+// Upload file with tus metadata. Resolves once the server has
+// received the whole file.
+async function upload(file, metadata) {
+	// If we tried uploading the same file before (e.g. before the
+	// browser crashed), try to continue where we left off.
+
+	const fingerprint = fingerprintOf(file, metadata)
+	let uploadUrl = fingerprint === null ? null : localStorage.getItem(fingerprint)
+	let offset = null
+
+	if (uploadUrl !== null) {
+		offset = await fetchOffset(uploadUrl)
+	}
+
+	if (offset === null) {
+		uploadUrl = await createUpload(file, metadata)
+		offset = 0
+
+		if (fingerprint !== null) {
+			localStorage.setItem(fingerprint, uploadUrl)
+		}
+	}
+
+	// Send the file chunk by chunk. We are only done once the server
+	// confirmed the last chunk, as that is when it creates the file.
+	// If that failed, we send an empty chunk at the end of the file,
+	// which makes the server try again.
+
+	let retries = 0
+	let finished = false
+
+	while (!finished) {
+		try {
+			offset = await sendChunk(uploadUrl, file, offset)
+			finished = offset >= file.size
+			retries = 0
+		} catch (e) {
+			if (retries >= RETRY_DELAYS.length) {
+				throw e
+			}
+
+			setProgressTextTo('Connection problems, retrying...')
+			await sleep(RETRY_DELAYS[retries])
+			retries += 1
+
+			const serverOffset = await fetchOffset(uploadUrl)
+
+			if (serverOffset === null) {
+				localStorage.removeItem(fingerprint)
+				throw e
+			}
+
+			offset = serverOffset
+		}
+	}
+
+	localStorage.removeItem(fingerprint)
 }
 
-function handleUploadLoad(e) {
-	location.reload(true)
-	State.set(State.Done)
+// Create a new upload on the server. Resolves to the URL of the
+// upload.
+async function createUpload(file, metadata) {
+	const response = await fetch('/tus', {
+		method: 'POST',
+		headers: {
+			'Tus-Resumable': TUS_VERSION,
+			'Upload-Length': String(file.size),
+			'Upload-Metadata': encodeMetadata(metadata),
+		},
+	})
+
+	if (response.status !== 201) {
+		throw new Error(`creating upload failed with status ${response.status}`)
+	}
+
+	return response.headers.get('Location')
 }
 
-function handleUploadProgress(e) {
-	const loaded = e.loaded
-	const total = e.total
+// Ask the server how many bytes of the upload at uploadUrl it got.
+// Resolves to null if the upload does not exist (anymore).
+async function fetchOffset(uploadUrl) {
+	try {
+		const response = await fetch(uploadUrl, {
+			method: 'HEAD',
+			headers: {'Tus-Resumable': TUS_VERSION},
+		})
+
+		if (response.status !== 200) {
+			return null
+		}
+
+		return parseInt(response.headers.get('Upload-Offset'), 10)
+	} catch (e) {
+		return null
+	}
+}
+
+// Send the next chunk of file starting at offset to the upload at
+// uploadUrl. Resolves to the new offset. We use XMLHttpRequest rather
+// than fetch because only the former reports upload progress.
+function sendChunk(uploadUrl, file, offset) {
+	return new Promise((resolve, reject) => {
+		const chunk = file.slice(offset, offset + CHUNK_SIZE)
+		const tx = new XMLHttpRequest()
+
+		tx.upload.addEventListener('progress', (e) => {
+			handleUploadProgress(offset + e.loaded, file.size)
+		})
+
+		tx.addEventListener('load', () => {
+			if (tx.status === 204) {
+				resolve(parseInt(tx.getResponseHeader('Upload-Offset'), 10))
+			} else {
+				reject(new Error(`sending chunk failed with status ${tx.status}`))
+			}
+		})
+
+		tx.addEventListener('abort', () => reject(new Error('sending chunk aborted')))
+		tx.addEventListener('error', () => reject(new Error('sending chunk failed')))
+
+		tx.open('PATCH', uploadUrl)
+		tx.setRequestHeader('Tus-Resumable', TUS_VERSION)
+		tx.setRequestHeader('Upload-Offset', String(offset))
+		tx.setRequestHeader('Content-Type', 'application/offset+octet-stream')
+		tx.send(chunk)
+	})
+}
+
+// Encode metadata as required for the Upload-Metadata header, i.e.
+// as comma separated list of keys and base64 encoded values.
+function encodeMetadata(metadata) {
+	return Object.entries(metadata).map(([key, value]) => {
+		const bytes = new TextEncoder().encode(value)
+		const binary = Array.from(bytes, (b) => String.fromCharCode(b)).join('')
+		return `${key} ${btoa(binary)}`
+	}).join(',')
+}
+
+// Return a key that (hopefully) identifies an upload of file with
+// metadata between page reloads.
+function fingerprintOf(file, metadata) {
+	// Fingerprints end up in localStorage, so keep passwords out of
+	// them. Uploads with a password are never resumed.
+
+	if (metadata.password) {
+		return null
+	}
+
+	return ['tus', file.name, file.size, file.lastModified, JSON.stringify(metadata)].join('::')
+}
+
+function sleep(ms) {
+	return new Promise((resolve) => setTimeout(resolve, ms))
+}
 
+function handleUploadProgress(loaded, total) {
 	const progress = Math.round(loaded / total * 100)
-	setProgressTextTo(`Uploading... ${progress}%`)
+	setProgressTextTo(`Uploading... ${window.uploadLabel || ''}${progress}%`)
 
 	State.set(State.Downloading)
 }
 
-function setProgressTextTo(html) {
+// Show text as progress. Messages can contain file names, so we set
+// them as text, never as HTML.
+function setProgressTextTo(text) {
 	const div = document.getElementById('file_progress')
-	div.innerHTML = html
+	div.textContent = text
 }
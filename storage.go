@@ -0,0 +1,615 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the blobs we store for each file.
+const (
+	// The actual contents of the uploaded file.
+	STORAGE_BLOB = "storage.bin"
+
+	// The thumbnail of the uploaded file. Only exists for
+	// some images.
+	THUMBNAIL_BLOB = "thumbnail.jpg"
+)
+
+// An opened blob. Supporting Seek allows us to serve blobs with
+// http.ServeContent and similar functions.
+type Blob interface {
+	io.ReadSeekCloser
+}
+
+// Storage is where fmajor keeps uploaded files and their metadata.
+//
+// Each uploaded file is identified by its Id and consists of some
+// metadata and a set of named blobs (see STORAGE_BLOB and THUMBNAIL_BLOB).
+// Additionally, short ids can be linked to file ids.
+//
+// The contents of uploaded files are kept in a shared content-addressed
+// area. Content is identified by its SHA-256 hash and reference counted,
+// so uploading the same file twice only stores it once. Files uploaded
+// before we had content-addressed storage keep their contents in blob
+// STORAGE_BLOB instead.
+//
+// If a master key is configured, backends encrypt blobs and content at
+// rest (see crypto.go). Callers always read and write plain text.
+//
+// Callers are expected to hold the right locks (see lock.go). Methods
+// that only touch the metadata and blobs of one existing file need the
+// lock of that file (LockFileRead and LockFileWrite). Everything else,
+// like creating and deleting files, links and content, needs the
+// directory-level lock (LockRead and LockWrite). SpoolContent needs
+// no lock at all. Implementations must be safe for concurrent use as
+// far as these locks allow it.
+type Storage interface {
+	// Store everything read from src as blob with given name for the
+	// file with given id. Returns the number of bytes written.
+	PutBlob(id, name string, src io.Reader) (int64, error)
+
+	// Open blob with given name for the file with given id. Close
+	// the returned Blob when you are done with it.
+	OpenBlob(id, name string) (Blob, error)
+
+	// Return the size in bytes of blob with given name for the file
+	// with given id.
+	StatBlob(id, name string) (int64, error)
+
+	// Store metadata meta. Overwrites existing metadata for the file
+	// with id meta.Id.
+	PutMeta(meta *File) error
+
+	// Load metadata for the file with given id. Fails with ErrNoMeta
+	// or ErrBadMeta if the metadata is missing or cannot be parsed.
+	GetMeta(id string) (*File, error)
+
+	// Link shortId to the file with given id. Returns an error if
+	// shortId is already in use.
+	PutLink(shortId, id string) error
+
+	// Return the file id shortId links to.
+	ResolveLink(shortId string) (string, error)
+
+	// Remove the link from shortId to its file. The file itself
+	// is left untouched.
+	DeleteLink(shortId string) error
+
+	// Store a new file with metadata meta and blobs named like the
+	// keys of blobs. Either everything is stored or, if this fails,
+	// nothing is. Returns an error if a file with id meta.Id exists
+	// already.
+	PutFile(meta *File, blobs map[string]io.Reader) error
+
+	// Delete metadata and all blobs for the file with given id.
+	Delete(id string) error
+
+	// Write everything read from src to a temporary place. This is
+	// the slow part of storing content, which is why it needs no lock.
+	// Pass the result to PutContent, then Discard it.
+	SpoolContent(src io.Reader) (*Spool, error)
+
+	// Store spooled content. If content with the same hash already
+	// exists, the new copy is discarded. In both cases, the reference
+	// count of the content is incremented.
+	PutContent(spool *Spool) error
+
+	// Open content with given hash. Close the returned Blob when
+	// you are done with it.
+	OpenContent(hash string) (Blob, error)
+
+	// Decrement the reference count of content with given hash.
+	// Once no references are left, the content is deleted.
+	ReleaseContent(hash string) error
+
+	// Return the ids of all stored files, including those with
+	// missing or broken metadata.
+	List() ([]string, error)
+
+	// Return all short ids that link to some file.
+	ListLinks() ([]string, error)
+
+	// Return the hashes of all stored content.
+	ListContent() ([]string, error)
+
+	// Return the reference count of content with given hash.
+	ContentRefs(hash string) (int, error)
+
+	// Set the reference count of content with given hash. Setting
+	// it to zero deletes the content. Only meant for repairing
+	// storage, see Fsck.
+	SetContentRefs(hash string, refs int) error
+
+	// Clean up what writes interrupted by a crash left behind. Call
+	// this once on startup before using the storage.
+	Recover() error
+
+	// Call rewrap with the first SEAL_HEADER_SIZE bytes of every blob
+	// and all content together with how they are sealed. If rewrap
+	// returns a non-nil slice, replace these bytes with it. Blobs shorter
+	// than SEAL_HEADER_SIZE and blobs that are never sealed are skipped.
+	// Used for rotating the master key.
+	RewrapBlobs(rewrap func(header []byte, sealing Sealing) ([]byte, error)) error
+}
+
+// Implemented by storage backends that can hand out URLs for
+// downloading blobs directly from the backend, bypassing fmajor.
+type Presigner interface {
+	// Return an URL that allows the client to download blob name
+	// of file meta. The backend should respond with the headers
+	// WriteHeadersFor would write. Returns ErrPresignDisabled if
+	// presigning was turned off in the config.
+	PresignBlob(meta *File, name string) (string, error)
+}
+
+// Returned by Presigner.PresignBlob if presigning is disabled.
+var ErrPresignDisabled = errors.New("presigning disabled")
+
+// Returned by Storage.GetMeta if the metadata of a file is missing or
+// broken. Other errors, e.g. from the disk or network, do not tell us
+// anything about the file itself.
+var (
+	ErrNoMeta  = errors.New("no metadata")
+	ErrBadMeta = errors.New("bad metadata")
+)
+
+// Global instance of the storage backend. Use GetStorage to
+// access this variable.
+var storage Storage
+var storageCreator sync.Once
+
+// Return the singleton instance of the storage backend as configured
+// in the config file.
+func GetStorage() Storage {
+	storageCreator.Do(loadStorage)
+	return storage
+}
+
+// Populate the "storage" global variable. If it fails, we can't continue,
+// in that case we stop the program.
+func loadStorage() {
+	c := GetConfig()
+
+	key, err := loadMasterKey(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage = &CheckedStorage{Backend: newBackend(c, key)}
+
+	log.Printf(`using StorageBackend="%v"`, c.StorageBackend)
+
+	if key != nil {
+		log.Printf("encrypting blobs at rest with key id=%v", key.Id())
+	}
+}
+
+// Return the storage backend configured in c. Blobs are encrypted with
+// key; if key is nil, they are stored as they are.
+func newBackend(c *Config, key *MasterKey) Storage {
+	switch c.StorageBackend {
+	case "", STORAGE_BACKEND_DIRECTORY:
+		return &DirectoryStorage{Root: c.UploadsDirectory, Key: key}
+	case STORAGE_BACKEND_S3:
+		return newS3Storage(c, key)
+	default:
+		log.Fatalf(`unknown StorageBackend="%v"`, c.StorageBackend)
+		return nil
+	}
+}
+
+// Storage that checks all ids with ParseFileId and ParseShortId before
+// passing them on to Backend. This way backends never see ids that could
+// escape their directory or key prefix, e.g. "../". Ids that fail the
+// check are reported as *InvalidIdError.
+type CheckedStorage struct {
+	Backend Storage
+}
+
+func (cs *CheckedStorage) PutBlob(id, name string, src io.Reader) (int64, error) {
+	if _, err := ParseFileId(id); err != nil {
+		return 0, err
+	}
+
+	return cs.Backend.PutBlob(id, name, src)
+}
+
+func (cs *CheckedStorage) OpenBlob(id, name string) (Blob, error) {
+	if _, err := ParseFileId(id); err != nil {
+		return nil, err
+	}
+
+	return cs.Backend.OpenBlob(id, name)
+}
+
+func (cs *CheckedStorage) StatBlob(id, name string) (int64, error) {
+	if _, err := ParseFileId(id); err != nil {
+		return 0, err
+	}
+
+	return cs.Backend.StatBlob(id, name)
+}
+
+func (cs *CheckedStorage) PutMeta(meta *File) error {
+	if _, err := ParseFileId(meta.Id); err != nil {
+		return err
+	}
+
+	return cs.Backend.PutMeta(meta)
+}
+
+func (cs *CheckedStorage) GetMeta(id string) (*File, error) {
+	if _, err := ParseFileId(id); err != nil {
+		return nil, err
+	}
+
+	meta, err := cs.Backend.GetMeta(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// don't trust the metadata blindly either, it might have been
+	// tampered with
+
+	if meta.Id != id {
+		return nil, errors.Wrapf(ErrBadMeta, `meta.json for id="%v" has mismatching id="%v"`, id, meta.Id)
+	}
+
+	return meta, nil
+}
+
+func (cs *CheckedStorage) PutLink(shortId, id string) error {
+	if _, err := ParseShortId(shortId); err != nil {
+		return err
+	}
+
+	if _, err := ParseFileId(id); err != nil {
+		return err
+	}
+
+	return cs.Backend.PutLink(shortId, id)
+}
+
+func (cs *CheckedStorage) ResolveLink(shortId string) (string, error) {
+	if _, err := ParseShortId(shortId); err != nil {
+		return "", err
+	}
+
+	id, err := cs.Backend.ResolveLink(shortId)
+	if err != nil {
+		return "", err
+	}
+
+	return ParseFileId(id)
+}
+
+func (cs *CheckedStorage) DeleteLink(shortId string) error {
+	if _, err := ParseShortId(shortId); err != nil {
+		return err
+	}
+
+	return cs.Backend.DeleteLink(shortId)
+}
+
+func (cs *CheckedStorage) Delete(id string) error {
+	if _, err := ParseFileId(id); err != nil {
+		return err
+	}
+
+	return cs.Backend.Delete(id)
+}
+
+func (cs *CheckedStorage) SpoolContent(src io.Reader) (*Spool, error) {
+	return cs.Backend.SpoolContent(src)
+}
+
+func (cs *CheckedStorage) PutContent(spool *Spool) error {
+	if _, err := ParseContentHash(spool.Hash); err != nil {
+		return err
+	}
+
+	return cs.Backend.PutContent(spool)
+}
+
+func (cs *CheckedStorage) OpenContent(hash string) (Blob, error) {
+	if _, err := ParseContentHash(hash); err != nil {
+		return nil, err
+	}
+
+	return cs.Backend.OpenContent(hash)
+}
+
+func (cs *CheckedStorage) ReleaseContent(hash string) error {
+	if _, err := ParseContentHash(hash); err != nil {
+		return err
+	}
+
+	return cs.Backend.ReleaseContent(hash)
+}
+
+func (cs *CheckedStorage) List() ([]string, error) {
+	ids, err := cs.Backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var checked []string
+
+	for _, id := range ids {
+		if _, err := ParseFileId(id); err != nil {
+			log.Printf("ignoring stored file: %v", err)
+			continue
+		}
+
+		checked = append(checked, id)
+	}
+
+	return checked, nil
+}
+
+func (cs *CheckedStorage) PutFile(meta *File, blobs map[string]io.Reader) error {
+	if _, err := ParseFileId(meta.Id); err != nil {
+		return err
+	}
+
+	return cs.Backend.PutFile(meta, blobs)
+}
+
+func (cs *CheckedStorage) Recover() error {
+	return cs.Backend.Recover()
+}
+
+func (cs *CheckedStorage) ListLinks() ([]string, error) {
+	shortIds, err := cs.Backend.ListLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	var checked []string
+
+	for _, shortId := range shortIds {
+		if _, err := ParseShortId(shortId); err != nil {
+			log.Printf("ignoring stored link: %v", err)
+			continue
+		}
+
+		checked = append(checked, shortId)
+	}
+
+	return checked, nil
+}
+
+func (cs *CheckedStorage) ListContent() ([]string, error) {
+	hashes, err := cs.Backend.ListContent()
+	if err != nil {
+		return nil, err
+	}
+
+	var checked []string
+
+	for _, hash := range hashes {
+		if _, err := ParseContentHash(hash); err != nil {
+			log.Printf("ignoring stored content: %v", err)
+			continue
+		}
+
+		checked = append(checked, hash)
+	}
+
+	return checked, nil
+}
+
+func (cs *CheckedStorage) ContentRefs(hash string) (int, error) {
+	if _, err := ParseContentHash(hash); err != nil {
+		return 0, err
+	}
+
+	return cs.Backend.ContentRefs(hash)
+}
+
+func (cs *CheckedStorage) SetContentRefs(hash string, refs int) error {
+	if _, err := ParseContentHash(hash); err != nil {
+		return err
+	}
+
+	return cs.Backend.SetContentRefs(hash, refs)
+}
+
+func (cs *CheckedStorage) RewrapBlobs(rewrap func(header []byte, sealing Sealing) ([]byte, error)) error {
+	return cs.Backend.RewrapBlobs(rewrap)
+}
+
+func (cs *CheckedStorage) PresignBlob(meta *File, name string) (string, error) {
+	presigner, ok := cs.Backend.(Presigner)
+	if !ok {
+		return "", ErrPresignDisabled
+	}
+
+	if _, err := ParseFileId(meta.Id); err != nil {
+		return "", err
+	}
+
+	return presigner.PresignBlob(meta, name)
+}
+
+// Content written to local disk by Storage.SpoolContent that is not
+// part of storage yet. While it exists, we hold a lock on the file so
+// Recover in other processes leaves it alone.
+type Spool struct {
+	// Hex encoded SHA-256 hash and size of the spooled content.
+	Hash string
+	Size int64
+
+	// The spooled content, sealed if a master key is configured.
+	file    *os.File
+	sealing Sealing
+
+	// Key of a copy of the spooled content that S3Storage uploaded
+	// ahead of PutContent. Empty if there is none.
+	staged string
+
+	// Called by Discard to remove what the backend created besides
+	// the spooled file. Nil if there is nothing.
+	discard func()
+}
+
+// Remove the spooled content. It is safe to call Discard after the
+// backend moved the spooled file away.
+func (sp *Spool) Discard() {
+	funlock(sp.file)
+	sp.file.Close()
+	os.Remove(sp.file.Name())
+
+	if sp.discard != nil {
+		sp.discard()
+		sp.discard = nil
+	}
+}
+
+// Copy everything read from src into a new temporary file in directory
+// dir while computing its SHA-256 hash. The copy is sealed with key, the
+// hash and size refer to the plain text. On success, the spooled file
+// is positioned at its start.
+func spoolContent(dir string, src io.Reader, key *MasterKey) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cannot create directory for incoming content")
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".incoming-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create file for incoming content")
+	}
+
+	spool := &Spool{file: tmp, sealing: key.Sealing()}
+	hasher := sha256.New()
+
+	_, err = tryFlockExclusive(tmp)
+
+	var sealer io.WriteCloser
+
+	if err == nil {
+		sealer, err = key.NewSealer(tmp)
+	}
+
+	if err == nil {
+		spool.Size, err = io.Copy(io.MultiWriter(sealer, hasher), src)
+	}
+
+	if err == nil {
+		err = sealer.Close()
+	}
+
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		spool.Discard()
+		return nil, errors.Wrap(err, "cannot write incoming content")
+	}
+
+	spool.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return spool, nil
+}
+
+// Remove path, a leftover of an interrupted write, unless somebody still
+// holds a lock on it because the write is in fact still going on in
+// another process.
+func removeLeftover(path string) error {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	locked, err := tryFlockExclusive(fd)
+	if err != nil || !locked {
+		return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	log.Printf(`removed leftover of interrupted write path="%v"`, path)
+	return nil
+}
+
+// Return how blob name is sealed. STORAGE_BLOB was only written
+// before we supported encryption, so it is never sealed. Thumbnails
+// are images we render ourselves, which only start with SEAL_MAGIC if
+// they are sealed.
+func blobSealing(name string) Sealing {
+	if name == STORAGE_BLOB {
+		return SEALING_PLAIN
+	}
+
+	return SEALING_UNKNOWN
+}
+
+// What the storage backends record next to each piece of content.
+// Whether content is sealed cannot be told from the content itself as
+// users may upload anything, including data that looks sealed.
+type contentRefs struct {
+	refs    int
+	sealing Sealing
+}
+
+// Parse references as stored by the storage backends, e.g. "2 sealed".
+// Missing references are stored as empty strings and mean zero. Older
+// versions only stored the count, we do not know whether their content
+// is sealed.
+func parseContentRefs(bs []byte) (contentRefs, error) {
+	fields := strings.Fields(string(bs))
+
+	if len(fields) == 0 {
+		return contentRefs{}, nil
+	}
+
+	refs, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return contentRefs{}, errors.Wrap(err, "malformed reference count")
+	}
+
+	cr := contentRefs{refs: refs}
+
+	switch {
+	case len(fields) == 1:
+		cr.sealing = SEALING_UNKNOWN
+	case len(fields) == 2 && fields[1] == "plain":
+		cr.sealing = SEALING_PLAIN
+	case len(fields) == 2 && fields[1] == "sealed":
+		cr.sealing = SEALING_SEALED
+	default:
+		return contentRefs{}, fmt.Errorf(`malformed references value="%v"`, string(bs))
+	}
+
+	return cr, nil
+}
+
+// Return references in the format understood by parseContentRefs.
+func (cr contentRefs) String() string {
+	switch cr.sealing {
+	case SEALING_PLAIN:
+		return fmt.Sprintf("%v plain", cr.refs)
+	case SEALING_SEALED:
+		return fmt.Sprintf("%v sealed", cr.refs)
+	default:
+		return strconv.Itoa(cr.refs)
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Directories inside Root for internal use.
+const (
+	// Where we keep content.
+	CONTENT_DIRECTORY = ".content"
+
+	// Where we prepare new files before moving them into place.
+	// Whatever is left in here after a crash is removed by Recover.
+	INCOMING_DIRECTORY = ".incoming"
+)
+
+// Storage implementation that keeps each file in its own directory
+// on the local file system. The layout looks like this:
+//
+//	<Root>/<id>/meta.json
+//	<Root>/<id>/storage.bin
+//	<Root>/<id>/thumbnail.jpg
+//	<Root>/<short id> -> <id>
+//	<Root>/.content/<first two characters of hash>/<hash>
+//	<Root>/.content/<first two characters of hash>/<hash>.refs
+//	<Root>/.incoming/...
+//
+// Short ids are implemented as symlinks to the file directory. Files in
+// .content contain content, the .refs files next to them the reference
+// count as decimal number. Entries starting with a dot are ignored when
+// listing files, which allows us to keep the staging directory inside
+// Root.
+//
+// We never write files in place. Everything is written to .incoming
+// first, flushed to disk and then renamed into place. New files are
+// prepared in a directory of their own which is renamed as a whole.
+// This way a crash never leaves behind half-written files.
+type DirectoryStorage struct {
+	// The directory to put everything in. Usually this is the
+	// UploadsDirectory from the config.
+	Root string
+
+	// If set, blobs and content are encrypted with this key.
+	Key *MasterKey
+}
+
+func (ds *DirectoryStorage) PutBlob(id, name string, src io.Reader) (int64, error) {
+	if _, err := os.Stat(ds.pathTo(id)); err != nil {
+		return 0, errors.Wrapf(err, `cannot find directory for id="%v"`, id)
+	}
+
+	var nbytes int64
+
+	err := ds.writeAtomic(ds.pathTo(id, name), func(w io.Writer) (err error) {
+		nbytes, err = ds.seal(w, src)
+		return err
+	})
+
+	if err != nil {
+		return nbytes, errors.Wrapf(err, `cannot write %v for id="%v"`, name, id)
+	}
+
+	return nbytes, nil
+}
+
+func (ds *DirectoryStorage) OpenBlob(id, name string) (Blob, error) {
+	return ds.open(ds.pathTo(id, name), blobSealing(name))
+}
+
+func (ds *DirectoryStorage) StatBlob(id, name string) (int64, error) {
+	// sealed blobs are larger than their plain text, so we cannot
+	// just look at the size of the file
+
+	blob, err := ds.OpenBlob(id, name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer blob.Close()
+
+	return blob.Seek(0, io.SeekEnd)
+}
+
+func (ds *DirectoryStorage) PutMeta(meta *File) error {
+	metabytes, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrapf(err, `cannot construct meta.json for id="%v"`, meta.Id)
+	}
+
+	if _, err := os.Stat(ds.pathTo(meta.Id)); err != nil {
+		return errors.Wrapf(err, `cannot find directory for id="%v"`, meta.Id)
+	}
+
+	err = ds.writeAtomic(ds.pathTo(meta.Id, "meta.json"), func(w io.Writer) error {
+		_, err := w.Write(metabytes)
+		return err
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, `cannot write meta.json for id="%v"`, meta.Id)
+	}
+
+	return nil
+}
+
+func (ds *DirectoryStorage) PutFile(meta *File, blobs map[string]io.Reader) error {
+	metabytes, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrapf(err, `cannot construct meta.json for id="%v"`, meta.Id)
+	}
+
+	// prepare the complete directory in INCOMING_DIRECTORY; once we
+	// remove it, the deferred RemoveAll does nothing
+
+	if err := os.MkdirAll(ds.pathTo(INCOMING_DIRECTORY), 0700); err != nil {
+		return errors.Wrap(err, "cannot create directory for incoming files")
+	}
+
+	staging, err := ioutil.TempDir(ds.pathTo(INCOMING_DIRECTORY), "file-*")
+	if err != nil {
+		return errors.Wrapf(err, `cannot create directory for id="%v"`, meta.Id)
+	}
+
+	defer os.RemoveAll(staging)
+
+	for name, src := range blobs {
+		src := src
+
+		err := writeSynced(filepath.Join(staging, name), func(w io.Writer) error {
+			_, err := ds.seal(w, src)
+			return err
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, `cannot write %v for id="%v"`, name, meta.Id)
+		}
+	}
+
+	err = writeSynced(filepath.Join(staging, "meta.json"), func(w io.Writer) error {
+		_, err := w.Write(metabytes)
+		return err
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, `cannot write meta.json for id="%v"`, meta.Id)
+	}
+
+	if err := syncDir(staging); err != nil {
+		return errors.Wrapf(err, `cannot sync directory for id="%v"`, meta.Id)
+	}
+
+	// rename would happily replace an empty directory, so we check
+	// for existing files ourselves
+
+	if _, err := os.Lstat(ds.pathTo(meta.Id)); err == nil {
+		return fmt.Errorf(`id="%v" exists already`, meta.Id)
+	}
+
+	if err := os.Rename(staging, ds.pathTo(meta.Id)); err != nil {
+		return errors.Wrapf(err, `cannot move directory for id="%v" into place`, meta.Id)
+	}
+
+	return syncDir(ds.Root)
+}
+
+func (ds *DirectoryStorage) GetMeta(id string) (*File, error) {
+	metabytes, err := ioutil.ReadFile(ds.pathTo(id, "meta.json"))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrNoMeta, `cannot open meta.json for id="%v"`, id)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, `cannot open meta.json for id="%v"`, id)
+	}
+
+	var meta File
+	if err := json.Unmarshal(metabytes, &meta); err != nil {
+		return nil, errors.Wrapf(ErrBadMeta, `cannot parse meta.json for id="%v": %v`, id, err)
+	}
+
+	return &meta, nil
+}
+
+func (ds *DirectoryStorage) PutLink(shortId, id string) error {
+	return os.Symlink(id, ds.pathTo(shortId))
+}
+
+func (ds *DirectoryStorage) ResolveLink(shortId string) (string, error) {
+	target, err := os.Readlink(ds.pathTo(shortId))
+	if err != nil {
+		return "", errors.Wrapf(err, `cannot resolve shortId="%v"`, shortId)
+	}
+
+	return target, nil
+}
+
+func (ds *DirectoryStorage) DeleteLink(shortId string) error {
+	if err := os.Remove(ds.pathTo(shortId)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, `cannot delete shortId="%v"`, shortId)
+	}
+
+	return nil
+}
+
+func (ds *DirectoryStorage) Delete(id string) error {
+	// we remove the files we know about one by one instead of calling
+	// os.RemoveAll; if there is something unexpected in the directory,
+	// removing the directory fails and we report the error
+
+	for _, name := range []string{"meta.json", STORAGE_BLOB, THUMBNAIL_BLOB} {
+		if err := os.Remove(ds.pathTo(id, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Remove(ds.pathTo(id))
+}
+
+func (ds *DirectoryStorage) SpoolContent(src io.Reader) (*Spool, error) {
+	// we spool into INCOMING_DIRECTORY so we can rename the spooled
+	// file into place without copying it again; that is also why we
+	// sync it here, PutContent is called with the write lock held
+
+	spool, err := spoolContent(ds.pathTo(INCOMING_DIRECTORY), src, ds.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := spool.file.Sync(); err != nil {
+		spool.Discard()
+		return nil, errors.Wrapf(err, `cannot sync content hash="%v"`, spool.Hash)
+	}
+
+	return spool, nil
+}
+
+func (ds *DirectoryStorage) PutContent(spool *Spool) error {
+	hash := spool.Hash
+
+	// closing drops our lock on the spooled file, but as we hold the
+	// write lock, Recover cannot run in the meantime
+
+	if err := spool.file.Close(); err != nil {
+		return errors.Wrapf(err, `cannot write content hash="%v"`, hash)
+	}
+
+	contentPath := ds.contentPathTo(hash)
+
+	if err := os.MkdirAll(filepath.Dir(contentPath), 0700); err != nil {
+		return errors.Wrapf(err, `cannot create directory for content hash="%v"`, hash)
+	}
+
+	cr, err := ds.readContentRefs(hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(contentPath); os.IsNotExist(err) {
+		if err := os.Rename(spool.file.Name(), contentPath); err != nil {
+			return errors.Wrapf(err, `cannot store content hash="%v"`, hash)
+		}
+
+		if err := syncDir(filepath.Dir(contentPath)); err != nil {
+			return errors.Wrapf(err, `cannot sync content hash="%v"`, hash)
+		}
+
+		cr.sealing = spool.sealing
+	} else if err != nil {
+		return errors.Wrapf(err, `cannot check for content hash="%v"`, hash)
+	}
+
+	cr.refs += 1
+	return ds.writeContentRefs(hash, cr)
+}
+
+func (ds *DirectoryStorage) OpenContent(hash string) (Blob, error) {
+	cr, err := ds.readContentRefs(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds.open(ds.contentPathTo(hash), cr.sealing)
+}
+
+func (ds *DirectoryStorage) ReleaseContent(hash string) error {
+	refs, err := ds.ContentRefs(hash)
+	if err != nil {
+		return err
+	}
+
+	return ds.SetContentRefs(hash, refs-1)
+}
+
+func (ds *DirectoryStorage) ContentRefs(hash string) (int, error) {
+	cr, err := ds.readContentRefs(hash)
+	return cr.refs, err
+}
+
+func (ds *DirectoryStorage) SetContentRefs(hash string, refs int) error {
+	cr, err := ds.readContentRefs(hash)
+	if err != nil {
+		return err
+	}
+
+	cr.refs = refs
+	return ds.writeContentRefs(hash, cr)
+}
+
+// Return what is recorded next to content with given hash.
+func (ds *DirectoryStorage) readContentRefs(hash string) (contentRefs, error) {
+	bs, err := ioutil.ReadFile(ds.contentPathTo(hash) + ".refs")
+	if err != nil && !os.IsNotExist(err) {
+		return contentRefs{}, errors.Wrapf(err, `cannot read references of content hash="%v"`, hash)
+	}
+
+	cr, err := parseContentRefs(bs)
+	if err != nil {
+		return contentRefs{}, errors.Wrapf(err, `bad references of content hash="%v"`, hash)
+	}
+
+	return cr, nil
+}
+
+// Record cr next to content with given hash. If no references are
+// left, the content is deleted.
+func (ds *DirectoryStorage) writeContentRefs(hash string, cr contentRefs) error {
+	contentPath := ds.contentPathTo(hash)
+
+	if cr.refs > 0 {
+		err := ds.writeAtomic(contentPath+".refs", func(w io.Writer) error {
+			_, err := io.WriteString(w, cr.String())
+			return err
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, `cannot write references of content hash="%v"`, hash)
+		}
+
+		return nil
+	}
+
+	// no references are left, so we delete the content
+
+	if err := os.Remove(contentPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, `cannot delete content hash="%v"`, hash)
+	}
+
+	if err := os.Remove(contentPath + ".refs"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, `cannot delete references of content hash="%v"`, hash)
+	}
+
+	return nil
+}
+
+func (ds *DirectoryStorage) List() ([]string, error) {
+	fis, err := ioutil.ReadDir(ds.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		if isSymlink(fi) {
+			continue
+		}
+
+		if !isDir(fi) {
+			continue
+		}
+
+		ids = append(ids, fi.Name())
+	}
+
+	return ids, nil
+}
+
+func (ds *DirectoryStorage) RewrapBlobs(rewrap func(header []byte, sealing Sealing) ([]byte, error)) error {
+	// the blobs of all files
+
+	ids, err := ds.List()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := ds.rewrapFile(ds.pathTo(id, THUMBNAIL_BLOB), blobSealing(THUMBNAIL_BLOB), rewrap); err != nil {
+			return err
+		}
+	}
+
+	// and all content
+
+	contentPaths, err := ds.contentPaths()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range contentPaths {
+		cr, err := ds.readContentRefs(filepath.Base(path))
+		if err != nil {
+			return err
+		}
+
+		if err := ds.rewrapFile(path, cr.sealing, rewrap); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ds *DirectoryStorage) Recover() error {
+	// files in INCOMING_DIRECTORY belong to writes that never finished;
+	// older versions spooled content into CONTENT_DIRECTORY instead
+
+	leftovers, err := filepath.Glob(ds.pathTo(INCOMING_DIRECTORY, "*"))
+	if err != nil {
+		return err
+	}
+
+	spooled, err := filepath.Glob(ds.pathTo(CONTENT_DIRECTORY, ".incoming-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range append(leftovers, spooled...) {
+		if err := removeLeftover(path); err != nil {
+			return errors.Wrapf(err, `cannot remove leftover path="%v"`, path)
+		}
+	}
+
+	return nil
+}
+
+// Return the paths of all content. We skip reference counts and content
+// that is still being spooled.
+func (ds *DirectoryStorage) contentPaths() ([]string, error) {
+	var paths []string
+
+	err := filepath.Walk(ds.pathTo(CONTENT_DIRECTORY), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") && !strings.HasSuffix(fi.Name(), ".refs") {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list content")
+	}
+
+	return paths, nil
+}
+
+// Open file at path and decrypt it if it is sealed.
+func (ds *DirectoryStorage) open(path string, sealing Sealing) (Blob, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds.Key.Unseal(fd, sealing)
+}
+
+// Seal everything read from src with ds.Key and write it to w. Returns
+// the number of bytes read from src.
+func (ds *DirectoryStorage) seal(w io.Writer, src io.Reader) (int64, error) {
+	sealer, err := ds.Key.NewSealer(w)
+	if err != nil {
+		return 0, err
+	}
+
+	nbytes, err := io.Copy(sealer, src)
+	if err != nil {
+		return nbytes, err
+	}
+
+	return nbytes, sealer.Close()
+}
+
+// Replace file at path with everything write writes. The new contents
+// are written to INCOMING_DIRECTORY first and then renamed into place,
+// so readers either see the old or the new contents, even after a crash.
+func (ds *DirectoryStorage) writeAtomic(path string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(ds.pathTo(INCOMING_DIRECTORY), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(ds.pathTo(INCOMING_DIRECTORY), "write-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	tmp.Close()
+
+	if err := writeSynced(tmp.Name(), write); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// Create file at path with everything write writes and flush it to
+// disk. The file is only readable by us.
+func writeSynced(path string, write func(w io.Writer) error) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	if err := write(fd); err != nil {
+		return err
+	}
+
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+
+	return fd.Close()
+}
+
+// Flush the directory at path to disk. This makes renames and newly
+// created files in this directory durable.
+func syncDir(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	return fd.Sync()
+}
+
+// Replace the header of file at path as described in RewrapBlobs.
+// Missing files are skipped. We write a new copy and rename it into
+// place so a crash leaves either the old or the new header, each of
+// which can be read with its key.
+func (ds *DirectoryStorage) rewrapFile(path string, sealing Sealing, rewrap func(header []byte, sealing Sealing) ([]byte, error)) error {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, `cannot open path="%v"`, path)
+	}
+
+	defer fd.Close()
+
+	header := make([]byte, SEAL_HEADER_SIZE)
+
+	if _, err := io.ReadFull(fd, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, `cannot read path="%v"`, path)
+	}
+
+	rewrapped, err := rewrap(header, sealing)
+	if err != nil {
+		return errors.Wrapf(err, `cannot rewrap path="%v"`, path)
+	}
+
+	if rewrapped == nil {
+		return nil
+	}
+
+	// fd is positioned right after the header; we close it before
+	// renaming as some systems do not replace files that are open
+
+	err = ds.writeAtomic(path, func(w io.Writer) error {
+		if _, err := w.Write(rewrapped); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, fd); err != nil {
+			return err
+		}
+
+		return fd.Close()
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, `cannot write path="%v"`, path)
+	}
+
+	return nil
+}
+
+func (ds *DirectoryStorage) ListLinks() ([]string, error) {
+	fis, err := ioutil.ReadDir(ds.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var shortIds []string
+
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), ".") && isSymlink(fi) {
+			shortIds = append(shortIds, fi.Name())
+		}
+	}
+
+	return shortIds, nil
+}
+
+func (ds *DirectoryStorage) ListContent() ([]string, error) {
+	var hashes []string
+
+	paths, err := ds.contentPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		hashes = append(hashes, filepath.Base(path))
+	}
+
+	return hashes, nil
+}
+
+// Return the local file system path to content with given hash.
+func (ds *DirectoryStorage) contentPathTo(hash string) string {
+	return ds.pathTo(CONTENT_DIRECTORY, hash[:2], hash)
+}
+
+// Return a local file system path to some file in the storage
+// directory.
+func (ds *DirectoryStorage) pathTo(elem ...string) string {
+	return filepath.Join(append([]string{ds.Root}, elem...)...)
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/kissen/fmajor/s3"
+	"github.com/pkg/errors"
+)
+
+// Staged uploads older than this are removed by Recover, see
+// S3Storage.SpoolContent.
+const STAGED_LEFTOVER_AGE = 24 * time.Hour
+
+// Storage implementation that keeps files in an S3-compatible bucket.
+// The layout mirrors DirectoryStorage:
+//
+//	<Prefix>files/<id>/meta.json
+//	<Prefix>files/<id>/storage.bin
+//	<Prefix>files/<id>/thumbnail.jpg
+//	<Prefix>links/<short id>
+//	<Prefix>content/<hash>
+//	<Prefix>content/<hash>.refs
+//	<Prefix>incoming/<unix time>-<random>
+//
+// Objects in links/ contain the id of the file they point to. Objects
+// ending in .refs contain the reference count of the content next to
+// them as decimal number. Objects in incoming/ are uploads that are
+// not in content/ yet, named after when we started uploading them.
+type S3Storage struct {
+	// Client for the bucket we put everything in.
+	Client *s3.Client
+
+	// Prefix prepended to all keys. Either empty or ending in a
+	// slash.
+	Prefix string
+
+	// How long presigned URLs returned from PresignBlob remain
+	// valid. If zero, PresignBlob returns ErrPresignDisabled.
+	PresignLifetime time.Duration
+
+	// Local directory where we spool incoming content while computing
+	// its hash.
+	StagingDirectory string
+
+	// If set, blobs and content are encrypted with this key. As S3
+	// would hand out encrypted blobs, presigning is turned off.
+	Key *MasterKey
+}
+
+// Create a new S3Storage as configured in c. Blobs are encrypted with
+// key unless it is nil.
+func newS3Storage(c *Config, key *MasterKey) *S3Storage {
+	accessKey := c.S3AccessKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	secretKey := c.S3SecretKey
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	client := &s3.Client{
+		Endpoint:  c.S3Endpoint,
+		Region:    c.S3Region,
+		Bucket:    c.S3Bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+
+	return &S3Storage{
+		Client:           client,
+		Prefix:           c.S3Prefix,
+		PresignLifetime:  c.S3PresignLifetime,
+		StagingDirectory: c.StagingDirectory,
+		Key:              key,
+	}
+}
+
+func (ss *S3Storage) PutBlob(id, name string, src io.Reader) (int64, error) {
+	if ss.Key == nil {
+		return ss.Client.Upload(ss.fileKey(id, name), src)
+	}
+
+	// Upload wants a reader, so we seal src in the background and
+	// pipe the result into Upload
+
+	pr, pw := io.Pipe()
+	nbytes := make(chan int64, 1)
+
+	go func() {
+		sealer, err := ss.Key.NewSealer(pw)
+		if err != nil {
+			nbytes <- 0
+			pw.CloseWithError(err)
+			return
+		}
+
+		n, err := io.Copy(sealer, src)
+		if err == nil {
+			err = sealer.Close()
+		}
+
+		nbytes <- n
+		pw.CloseWithError(err)
+	}()
+
+	_, err := ss.Client.Upload(ss.fileKey(id, name), pr)
+
+	// make sure the goroutine above is done with src before we
+	// return; it stops at the latest when it next writes to pr
+
+	pr.CloseWithError(errors.New("upload stopped"))
+	n := <-nbytes
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (ss *S3Storage) OpenBlob(id, name string) (Blob, error) {
+	return ss.open(ss.fileKey(id, name), blobSealing(name))
+}
+
+func (ss *S3Storage) StatBlob(id, name string) (int64, error) {
+	if ss.Key == nil {
+		return ss.Client.Stat(ss.fileKey(id, name))
+	}
+
+	// sealed blobs are larger than their plain text, so we cannot
+	// just look at the size of the object
+
+	blob, err := ss.OpenBlob(id, name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer blob.Close()
+
+	return blob.Seek(0, io.SeekEnd)
+}
+
+func (ss *S3Storage) PutMeta(meta *File) error {
+	metabytes, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrapf(err, `cannot construct meta.json for id="%v"`, meta.Id)
+	}
+
+	key := ss.fileKey(meta.Id, "meta.json")
+	size := int64(len(metabytes))
+
+	if err := ss.Client.Put(key, bytes.NewReader(metabytes), size); err != nil {
+		return errors.Wrapf(err, `cannot write meta.json for id="%v"`, meta.Id)
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) PutFile(meta *File, blobs map[string]io.Reader) error {
+	if _, err := ss.Client.Stat(ss.fileKey(meta.Id, "meta.json")); err == nil {
+		return fmt.Errorf(`id="%v" exists already`, meta.Id)
+	} else if errors.Cause(err) != s3.ErrNotFound {
+		return errors.Wrapf(err, `cannot check whether id="%v" exists`, meta.Id)
+	}
+
+	// S3 cannot write several objects at once; as we write meta.json
+	// last, files without it are incomplete and fsck cleans them up
+
+	for name, src := range blobs {
+		if _, err := ss.PutBlob(meta.Id, name, src); err != nil {
+			ss.Delete(meta.Id)
+			return errors.Wrapf(err, `cannot write %v for id="%v"`, name, meta.Id)
+		}
+	}
+
+	if err := ss.PutMeta(meta); err != nil {
+		ss.Delete(meta.Id)
+		return err
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) GetMeta(id string) (*File, error) {
+	metabytes, err := ss.getSmall(ss.fileKey(id, "meta.json"))
+	if errors.Cause(err) == s3.ErrNotFound {
+		return nil, errors.Wrapf(ErrNoMeta, `cannot open meta.json for id="%v"`, id)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, `cannot open meta.json for id="%v"`, id)
+	}
+
+	var meta File
+	if err := json.Unmarshal(metabytes, &meta); err != nil {
+		return nil, errors.Wrapf(ErrBadMeta, `cannot parse meta.json for id="%v": %v`, id, err)
+	}
+
+	return &meta, nil
+}
+
+func (ss *S3Storage) PutLink(shortId, id string) error {
+	key := ss.linkKey(shortId)
+
+	if _, err := ss.Client.Stat(key); err == nil {
+		return fmt.Errorf(`shortId="%v" already in use`, shortId)
+	} else if errors.Cause(err) != s3.ErrNotFound {
+		return err
+	}
+
+	return ss.Client.Put(key, strings.NewReader(id), int64(len(id)))
+}
+
+func (ss *S3Storage) ResolveLink(shortId string) (string, error) {
+	target, err := ss.getSmall(ss.linkKey(shortId))
+	if err != nil {
+		return "", errors.Wrapf(err, `cannot resolve shortId="%v"`, shortId)
+	}
+
+	return string(target), nil
+}
+
+func (ss *S3Storage) DeleteLink(shortId string) error {
+	if err := ss.Client.Delete(ss.linkKey(shortId)); err != nil {
+		return errors.Wrapf(err, `cannot delete shortId="%v"`, shortId)
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) Delete(id string) error {
+	// S3 does not complain about deleting missing objects. To match
+	// the behavior of the other backends, report an error if the file
+	// did not exist in the first place.
+
+	objects, err := ss.Client.List(ss.fileKey(id, ""))
+	if err != nil {
+		return err
+	}
+
+	if len(objects) == 0 {
+		return fmt.Errorf(`cannot delete id="%v": no such file`, id)
+	}
+
+	for _, object := range objects {
+		if err := ss.Client.Delete(object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) SpoolContent(src io.Reader) (*Spool, error) {
+	// we only know the key once we have seen all of src, so spool
+	// everything to local disk first
+
+	spool, err := spoolContent(ss.StagingDirectory, src, ss.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// uploading takes long, so we do it here rather than in PutContent,
+	// which runs while holding the write lock; we upload to a key of
+	// our own, PutContent only copies that object into place
+
+	if _, err := ss.Client.Stat(ss.contentKey(spool.Hash)); err == nil {
+		return spool, nil
+	} else if errors.Cause(err) != s3.ErrNotFound {
+		spool.Discard()
+		return nil, errors.Wrapf(err, `cannot check for content hash="%v"`, spool.Hash)
+	}
+
+	staged := fmt.Sprintf("%vincoming/%v-%v", ss.Prefix, time.Now().Unix(), uniuri.NewLen(16))
+
+	if _, err := ss.Client.Upload(staged, spool.file); err != nil {
+		spool.Discard()
+		return nil, errors.Wrapf(err, `cannot upload content hash="%v"`, spool.Hash)
+	}
+
+	spool.staged = staged
+	spool.discard = func() {
+		if err := ss.Client.Delete(staged); err != nil {
+			log.Printf(`cannot delete staged content key="%v": %v`, staged, err)
+		}
+	}
+
+	return spool, nil
+}
+
+func (ss *S3Storage) PutContent(spool *Spool) error {
+	// we must not write to the content key before holding the write
+	// lock, as a concurrent upload of the same content could replace
+	// the object while somebody reads it; copying the staged object
+	// happens inside S3 and is quick compared to uploading
+
+	hash := spool.Hash
+	key := ss.contentKey(hash)
+
+	cr, err := ss.readContentRefs(hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ss.Client.Stat(key); errors.Cause(err) == s3.ErrNotFound {
+		if err := ss.putSpooled(spool, key); err != nil {
+			return errors.Wrapf(err, `cannot store content hash="%v"`, hash)
+		}
+
+		cr.sealing = spool.sealing
+	} else if err != nil {
+		return errors.Wrapf(err, `cannot check for content hash="%v"`, hash)
+	}
+
+	cr.refs += 1
+	return ss.writeContentRefs(hash, cr)
+}
+
+func (ss *S3Storage) OpenContent(hash string) (Blob, error) {
+	cr, err := ss.readContentRefs(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.open(ss.contentKey(hash), cr.sealing)
+}
+
+func (ss *S3Storage) ReleaseContent(hash string) error {
+	refs, err := ss.ContentRefs(hash)
+	if err != nil {
+		return err
+	}
+
+	return ss.SetContentRefs(hash, refs-1)
+}
+
+func (ss *S3Storage) ContentRefs(hash string) (int, error) {
+	cr, err := ss.readContentRefs(hash)
+	return cr.refs, err
+}
+
+func (ss *S3Storage) SetContentRefs(hash string, refs int) error {
+	cr, err := ss.readContentRefs(hash)
+	if err != nil {
+		return err
+	}
+
+	cr.refs = refs
+	return ss.writeContentRefs(hash, cr)
+}
+
+// Return what is recorded next to content with given hash.
+func (ss *S3Storage) readContentRefs(hash string) (contentRefs, error) {
+	bs, err := ss.getSmall(ss.contentKey(hash) + ".refs")
+	if err != nil && errors.Cause(err) != s3.ErrNotFound {
+		return contentRefs{}, errors.Wrapf(err, `cannot read references of content hash="%v"`, hash)
+	}
+
+	cr, err := parseContentRefs(bs)
+	if err != nil {
+		return contentRefs{}, errors.Wrapf(err, `bad references of content hash="%v"`, hash)
+	}
+
+	return cr, nil
+}
+
+// Record cr next to content with given hash. If no references are
+// left, the content is deleted.
+func (ss *S3Storage) writeContentRefs(hash string, cr contentRefs) error {
+	key := ss.contentKey(hash)
+
+	if cr.refs > 0 {
+		value := cr.String()
+
+		if err := ss.Client.Put(key+".refs", strings.NewReader(value), int64(len(value))); err != nil {
+			return errors.Wrapf(err, `cannot write references of content hash="%v"`, hash)
+		}
+
+		return nil
+	}
+
+	// no references are left, so we delete the content
+
+	if err := ss.Client.Delete(key); err != nil {
+		return errors.Wrapf(err, `cannot delete content hash="%v"`, hash)
+	}
+
+	if err := ss.Client.Delete(key + ".refs"); err != nil {
+		return errors.Wrapf(err, `cannot delete references of content hash="%v"`, hash)
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) List() ([]string, error) {
+	prefix := ss.Prefix + "files/"
+
+	objects, err := ss.Client.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// objects are listed in order, so all objects of one file
+	// follow each other
+
+	var ids []string
+
+	for _, object := range objects {
+		rest := strings.TrimPrefix(object.Key, prefix)
+
+		id, _, ok := strings.Cut(rest, "/")
+		if !ok {
+			continue
+		}
+
+		if len(ids) == 0 || ids[len(ids)-1] != id {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (ss *S3Storage) Recover() error {
+	// we only ever write complete objects to S3, but content spooled
+	// to local disk might be left over
+
+	spooled, err := filepath.Glob(filepath.Join(ss.StagingDirectory, ".incoming-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range spooled {
+		if err := removeLeftover(path); err != nil {
+			return errors.Wrapf(err, `cannot remove leftover path="%v"`, path)
+		}
+	}
+
+	// the same goes for staged uploads; we cannot lock objects, so we
+	// leave recent ones alone as other instances might still use them
+
+	prefix := ss.Prefix + "incoming/"
+
+	objects, err := ss.Client.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		started, _, _ := strings.Cut(strings.TrimPrefix(object.Key, prefix), "-")
+
+		if unix, err := strconv.ParseInt(started, 10, 64); err == nil && time.Since(time.Unix(unix, 0)) < STAGED_LEFTOVER_AGE {
+			continue
+		}
+
+		if err := ss.Client.Delete(object.Key); err != nil {
+			return err
+		}
+
+		log.Printf(`removed leftover of interrupted upload key="%v"`, object.Key)
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) ListLinks() ([]string, error) {
+	prefix := ss.Prefix + "links/"
+
+	objects, err := ss.Client.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var shortIds []string
+
+	for _, object := range objects {
+		shortIds = append(shortIds, strings.TrimPrefix(object.Key, prefix))
+	}
+
+	return shortIds, nil
+}
+
+func (ss *S3Storage) ListContent() ([]string, error) {
+	prefix := ss.Prefix + "content/"
+
+	objects, err := ss.Client.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".refs") {
+			hashes = append(hashes, strings.TrimPrefix(object.Key, prefix))
+		}
+	}
+
+	return hashes, nil
+}
+
+func (ss *S3Storage) RewrapBlobs(rewrap func(header []byte, sealing Sealing) ([]byte, error)) error {
+	// the blobs of all files
+
+	files, err := ss.Client.List(ss.Prefix + "files/")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range files {
+		if !strings.HasSuffix(object.Key, "/"+THUMBNAIL_BLOB) {
+			continue
+		}
+
+		if err := ss.rewrapObject(object.Key, blobSealing(THUMBNAIL_BLOB), rewrap); err != nil {
+			return err
+		}
+	}
+
+	// and all content
+
+	hashes, err := ss.ListContent()
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		cr, err := ss.readContentRefs(hash)
+		if err != nil {
+			return err
+		}
+
+		if err := ss.rewrapObject(ss.contentKey(hash), cr.sealing, rewrap); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replace the header of object key as described in RewrapBlobs. S3 has
+// no way of changing parts of an object, so we upload it again.
+func (ss *S3Storage) rewrapObject(key string, sealing Sealing, rewrap func(header []byte, sealing Sealing) ([]byte, error)) error {
+	body, _, err := ss.Client.Get(key, 0)
+	if err != nil {
+		return err
+	}
+
+	defer body.Close()
+
+	header := make([]byte, SEAL_HEADER_SIZE)
+
+	if _, err := io.ReadFull(body, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, `cannot read key="%v"`, key)
+	}
+
+	rewrapped, err := rewrap(header, sealing)
+	if err != nil {
+		return errors.Wrapf(err, `cannot rewrap key="%v"`, key)
+	}
+
+	if rewrapped == nil {
+		return nil
+	}
+
+	if _, err := ss.Client.Upload(key, io.MultiReader(bytes.NewReader(rewrapped), body)); err != nil {
+		return errors.Wrapf(err, `cannot write key="%v"`, key)
+	}
+
+	return nil
+}
+
+func (ss *S3Storage) PresignBlob(meta *File, name string) (string, error) {
+	if ss.PresignLifetime <= 0 || ss.Key != nil {
+		return "", ErrPresignDisabled
+	}
+
+	response := url.Values{}
+
+	if name == STORAGE_BLOB {
+		response.Set("response-content-type", meta.ContentType)
+
+		if meta.Inline() {
+			response.Set("response-content-disposition", "inline")
+		} else {
+			response.Set("response-content-disposition", "attachment")
+		}
+	}
+
+	key := ss.fileKey(meta.Id, name)
+
+	if name == STORAGE_BLOB && meta.HasContent() {
+		key = ss.contentKey(meta.ContentHash)
+	}
+
+	// S3 would send encoded contents without the matching
+	// Content-Encoding, so we serve these ourselves
+
+	if name == STORAGE_BLOB && meta.IsEncoded() {
+		return "", ErrPresignDisabled
+	}
+
+	return ss.Client.PresignGet(key, ss.PresignLifetime, response)
+}
+
+// Write the content in spool to key, preferably by copying the staged
+// object created in SpoolContent.
+func (ss *S3Storage) putSpooled(spool *Spool, key string) error {
+	// the content existed when we spooled it but was deleted since
+
+	if spool.staged == "" {
+		_, err := ss.Client.Upload(key, spool.file)
+		return err
+	}
+
+	return ss.Client.Copy(spool.staged, key)
+}
+
+// Open object key and decrypt it if it is sealed.
+func (ss *S3Storage) open(key string, sealing Sealing) (Blob, error) {
+	size, err := ss.Client.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.Key.Unseal(&s3Blob{client: ss.Client, key: key, size: size}, sealing)
+}
+
+// Read all of small object key into memory.
+func (ss *S3Storage) getSmall(key string) ([]byte, error) {
+	body, _, err := ss.Client.Get(key, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func (ss *S3Storage) fileKey(id, name string) string {
+	return ss.Prefix + "files/" + id + "/" + name
+}
+
+func (ss *S3Storage) contentKey(hash string) string {
+	return ss.Prefix + "content/" + hash
+}
+
+func (ss *S3Storage) linkKey(shortId string) string {
+	return ss.Prefix + "links/" + shortId
+}
+
+// A blob stored in S3. Reads are forwarded to a GET request for the
+// object which is only issued when actually reading. Seeking closes
+// the running request, the next read then starts a new request at the
+// new offset.
+type s3Blob struct {
+	client *s3.Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (sb *s3Blob) Read(p []byte) (int, error) {
+	if sb.offset >= sb.size {
+		return 0, io.EOF
+	}
+
+	if sb.body == nil {
+		body, _, err := sb.client.Get(sb.key, sb.offset)
+		if err != nil {
+			return 0, err
+		}
+
+		sb.body = body
+	}
+
+	n, err := sb.body.Read(p)
+	sb.offset += int64(n)
+
+	return n, err
+}
+
+func (sb *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = sb.offset + offset
+	case io.SeekEnd:
+		abs = sb.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if abs != sb.offset {
+		sb.Close()
+		sb.offset = abs
+	}
+
+	return abs, nil
+}
+
+func (sb *s3Blob) Close() error {
+	if sb.body == nil {
+		return nil
+	}
+
+	err := sb.body.Close()
+	sb.body = nil
+
+	return err
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/kissen/stringset"
+	"github.com/pkg/errors"
+)
+
+// Scopes an API token can be restricted to.
+const (
+	// Allows uploading new files.
+	SCOPE_UPLOAD = "upload"
+
+	// Allows deleting files.
+	SCOPE_DELETE = "delete"
+
+	// Allows listing files and reading their metadata.
+	SCOPE_LIST = "list"
+)
+
+// All scopes in the order we present them to the user.
+var AllScopes = []string{SCOPE_UPLOAD, SCOPE_DELETE, SCOPE_LIST}
+
+// Prefix of all tokens we generate. Makes tokens easy to recognize,
+// e.g. when they leak into logs.
+const TOKEN_PREFIX = "fmajor_"
+
+// Number of random characters in a token.
+const TOKEN_LENGTH = 40
+
+// An API token used by non-browser clients. We never store the token
+// itself, only its hash.
+type ApiToken struct {
+	// Randomly chosen id of this token. Used for revoking it.
+	Id string
+
+	// Name of this token as chosen by the user, e.g. "ci".
+	Name string
+
+	// Name of the user who created this token. Requests with this
+	// token act on behalf of that user. Empty for tokens created
+	// by legacy users, see Config.PassHashes.
+	Owner string
+
+	// Hex encoded SHA-256 hash of the token.
+	Hash string
+
+	// What this token allows its owner to do.
+	Scopes []string
+
+	// When this token was created.
+	CreatedOnUTC time.Time
+
+	// When this token stops working. Nil if it never expires.
+	ExpiresOnUTC *time.Time
+}
+
+// Return whether this token allows scope.
+func (t *ApiToken) HasScope(scope string) bool {
+	return stringset.NewWith(t.Scopes...).Contains(scope)
+}
+
+// Return whether this token has expired.
+func (t *ApiToken) Expired() bool {
+	return t.ExpiresOnUTC != nil && time.Now().UTC().After(*t.ExpiresOnUTC)
+}
+
+// Return Scopes as a human-readable string.
+func (t *ApiToken) HumanScopes() string {
+	return strings.Join(t.Scopes, ", ")
+}
+
+// Return creation date as human-readable string.
+func (t *ApiToken) HumanCreatedOn() string {
+	return t.CreatedOnUTC.Format("2006-01-02 15:04")
+}
+
+// Return expiry date as human-readable string.
+func (t *ApiToken) HumanExpiresOn() string {
+	if t.ExpiresOnUTC == nil {
+		return "never"
+	}
+
+	return t.ExpiresOnUTC.Format("2006-01-02 15:04")
+}
+
+// Protects the tokens file from concurrent modification within this
+// process. Other processes are kept out with lockTokensFile.
+var tokensLock sync.Mutex
+
+// Return all API tokens, including expired ones.
+func Tokens() ([]*ApiToken, error) {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	return loadTokens()
+}
+
+// Create a new API token for user owner. Returns the token, which is
+// the only time the token is available in plain text, and its metadata.
+// If lifetime is zero, the token never expires.
+func CreateToken(owner, name string, scopes []string, lifetime time.Duration) (string, *ApiToken, error) {
+	if name == "" {
+		return "", nil, errors.New("empty token name")
+	}
+
+	known := stringset.NewWith(AllScopes...)
+
+	for _, scope := range scopes {
+		if !known.Contains(scope) {
+			return "", nil, fmt.Errorf(`unknown scope="%v"`, scope)
+		}
+	}
+
+	token := TOKEN_PREFIX + uniuri.NewLen(TOKEN_LENGTH)
+
+	meta := ApiToken{
+		Id:           uniuri.NewLen(8),
+		Name:         name,
+		Owner:        owner,
+		Hash:         hashToken(token),
+		Scopes:       scopes,
+		CreatedOnUTC: time.Now().UTC(),
+	}
+
+	if lifetime > 0 {
+		expires := meta.CreatedOnUTC.Add(lifetime)
+		meta.ExpiresOnUTC = &expires
+	}
+
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	lease, err := lockTokensFile()
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer lease.Unlock()
+
+	tokens, err := loadTokens()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := storeTokens(append(tokens, &meta)); err != nil {
+		return "", nil, err
+	}
+
+	return token, &meta, nil
+}
+
+// Revoke the API token with given id.
+func RevokeToken(id string) error {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	lease, err := lockTokensFile()
+	if err != nil {
+		return err
+	}
+
+	defer lease.Unlock()
+
+	tokens, err := loadTokens()
+	if err != nil {
+		return err
+	}
+
+	var kept []*ApiToken
+
+	for _, t := range tokens {
+		if t.Id != id {
+			kept = append(kept, t)
+		}
+	}
+
+	if len(kept) == len(tokens) {
+		return fmt.Errorf(`no token with id="%v"`, id)
+	}
+
+	return storeTokens(kept)
+}
+
+// Look up the metadata for token. Returns an error if the token is
+// unknown or expired.
+func LookupToken(token string) (*ApiToken, error) {
+	tokens, err := Tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := []byte(hashToken(token))
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) != 1 {
+			continue
+		}
+
+		if t.Expired() {
+			return nil, errors.New("token expired")
+		}
+
+		return t, nil
+	}
+
+	return nil, errors.New("unknown token")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Lock the tokens file against other processes, e.g. the "token"
+// command running while the web server is up. Reading needs no lock
+// as storeTokens replaces the file atomically. Only call this function
+// if you are holding tokensLock.
+func lockTokensFile() (*Unlocker, error) {
+	return LockFile(GetConfig().TokensFile + ".lock")
+}
+
+// Read all tokens from the tokens file. A missing file is treated
+// like an empty one. Only call this function if you are holding
+// tokensLock.
+func loadTokens() ([]*ApiToken, error) {
+	bs, err := ioutil.ReadFile(GetConfig().TokensFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read tokens file")
+	}
+
+	var tokens []*ApiToken
+	if err := json.Unmarshal(bs, &tokens); err != nil {
+		return nil, errors.Wrap(err, "cannot parse tokens file")
+	}
+
+	return tokens, nil
+}
+
+// Replace the contents of the tokens file with tokens. Only call this
+// function if you are holding tokensLock.
+func storeTokens(tokens []*ApiToken) error {
+	if tokens == nil {
+		tokens = []*ApiToken{}
+	}
+
+	bs, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "cannot construct tokens file")
+	}
+
+	// write to a temporary file first so we never leave behind
+	// a half-written tokens file
+
+	path := GetConfig().TokensFile
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tokens-*")
+	if err != nil {
+		return errors.Wrap(err, "cannot create tokens file")
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(bs); err != nil {
+		return errors.Wrap(err, "cannot write tokens file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot write tokens file")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "cannot replace tokens file")
+	}
+
+	return nil
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Implementation of the tus protocol for resumable uploads. See
+// https://tus.io/protocols/resumable-upload for the specification.
+//
+// While an upload is in progress, we keep its contents in the staging
+// directory. Only when all bytes have arrived is the upload handed to
+// CreateFile and turns into a regular file.
+
+// The version of the tus protocol we implement.
+const TUS_VERSION = "1.0.0"
+
+// The tus extensions we implement.
+const TUS_EXTENSIONS = "creation,termination,expiration"
+
+// How long an unfinished upload is kept around after it was created.
+const TUS_UPLOAD_LIFETIME = 24 * time.Hour
+
+// How often we look for expired uploads.
+const TUS_REAP_INTERVAL = time.Hour
+
+// Returned by appendTusUpload if the client sends more bytes than it
+// announced with Upload-Length.
+var ErrTusTooLong = errors.New("request body exceeds Upload-Length")
+
+// Bookkeeping for a single unfinished upload. Stored as JSON next
+// to the uploaded bytes.
+type TusUpload struct {
+	// Randomly chosen id of this upload.
+	Id string
+
+	// Total number of bytes the client is going to send.
+	Length int64
+
+	// Name of the file to create once the upload is finished.
+	Filename string
+
+	// Options for creating the file once the upload is finished.
+	Options CreateOptions
+
+	// When this upload expires.
+	ExpiresOnUTC time.Time
+
+	// Id of the file created once all bytes arrived. Empty while
+	// the upload is unfinished. We keep finished uploads around until
+	// they expire, so clients that missed our response to their last
+	// PATCH learn about the file instead of creating it again.
+	FileId string `json:",omitempty"`
+}
+
+// Return whether all bytes arrived and the file was created.
+func (upload *TusUpload) Finished() bool {
+	return upload.FileId != ""
+}
+
+// Uploads that are currently written to in this process, mapped to the
+// locked info file that keeps out other processes. Protected by
+// tusBusyLock. We use this to reject concurrent PATCH requests to the
+// same upload.
+var tusBusy = make(map[string]*os.File)
+var tusBusyLock sync.Mutex
+
+// OPTIONS /tus
+func OptionsTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TUS_VERSION)
+	w.Header().Set("Tus-Version", TUS_VERSION)
+	w.Header().Set("Tus-Extension", TUS_EXTENSIONS)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(GetConfig().MaxFileSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /tus
+func PostTus(w http.ResponseWriter, r *http.Request) {
+	if ok := tusPreamble(w, r); !ok {
+		return
+	}
+
+	// Figure out what the client wants to upload.
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		DoError(w, r, http.StatusBadRequest, "bad Upload-Length")
+		return
+	}
+
+	if length > GetConfig().MaxFileSize {
+		DoError(w, r, http.StatusRequestEntityTooLarge, "Upload-Length exceeds MaxFileSize")
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filename := path.Base(metadata["filename"])
+	if filename == "" || filename == "." || filename == "/" {
+		DoError(w, r, http.StatusBadRequest, "missing filename in Upload-Metadata")
+		return
+	}
+
+	lifetime, err := parseLifetime(metadata["lifetime"])
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	maxDownloads, err := parseMaxDownloads(metadata["max_downloads"])
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	passHash, err := parsePassword(metadata["password"])
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// files uploaded as part of a folder also tell us their path
+	// relative to that folder
+
+	_, relPath := parseUploadPath(metadata["path"])
+
+	collections, err := parseCollections([]string{metadata["collection"]})
+	if err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	createCollection := metadata["create_collection"] == "true"
+
+	if err := prepareUploadCollections(collections, createCollection); err != nil {
+		DoError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Set up the staging area.
+
+	upload := TusUpload{
+		Id:       uuid.New().String(),
+		Length:   length,
+		Filename: filename,
+		Options: CreateOptions{
+			CreateShortId:     metadata["create_short_id"] == "true",
+			Lifetime:          lifetime,
+			MaxDownloads:      maxDownloads,
+			PassHash:          passHash,
+			Owner:             user.Name,
+			Collections:       collections,
+			Path:              relPath,
+			CreateCollections: createCollection,
+		},
+		ExpiresOnUTC: time.Now().UTC().Add(TUS_UPLOAD_LIFETIME),
+	}
+
+	if err := createTusUpload(&upload); err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", path.Join("/tus", upload.Id))
+	w.Header().Set("Upload-Expires", upload.ExpiresOnUTC.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /tus/{upload_id}
+func HeadTus(w http.ResponseWriter, r *http.Request) {
+	if ok := tusPreamble(w, r); !ok {
+		return
+	}
+
+	upload, offset, ok := loadTusUploadFor(w, r, mux.Vars(r)["upload_id"])
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresOnUTC.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /tus/{upload_id}
+func PatchTus(w http.ResponseWriter, r *http.Request) {
+	if ok := tusPreamble(w, r); !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		DoError(w, r, http.StatusUnsupportedMediaType, "bad Content-Type")
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		DoError(w, r, http.StatusBadRequest, "bad Upload-Offset")
+		return
+	}
+
+	// Make sure nobody else is writing to this upload right now.
+
+	id := mux.Vars(r)["upload_id"]
+
+	if ok := markTusBusy(id); !ok {
+		DoError(w, r, http.StatusConflict, "upload is already in progress")
+		return
+	}
+
+	defer unmarkTusBusy(id)
+
+	// Append the bytes we got to the staging file.
+
+	upload, offset, ok := loadTusUploadFor(w, r, id)
+	if !ok {
+		return
+	}
+
+	if offset != requestOffset {
+		DoError(w, r, http.StatusConflict, "Upload-Offset does not match")
+		return
+	}
+
+	if r.ContentLength > upload.Length-offset {
+		DoError(w, r, http.StatusRequestEntityTooLarge, ErrTusTooLong.Error())
+		return
+	}
+
+	// An earlier request finished the upload, but the client might
+	// not have got our response.
+
+	if upload.Finished() {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresOnUTC.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	offset, err = appendTusUpload(upload, offset, r.Body)
+	if err == ErrTusTooLong {
+		DoError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	if err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// If this was the last chunk, register the file in bookkeeping.
+	// If that fails, the client can try again by sending an empty
+	// chunk at the end of the upload.
+
+	if offset == upload.Length {
+		if err := finishTusUpload(upload); err != nil {
+			DoError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresOnUTC.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /tus/{upload_id}
+func DeleteTus(w http.ResponseWriter, r *http.Request) {
+	if ok := tusPreamble(w, r); !ok {
+		return
+	}
+
+	id := mux.Vars(r)["upload_id"]
+
+	if ok := markTusBusy(id); !ok {
+		DoError(w, r, http.StatusConflict, "upload is in progress")
+		return
+	}
+
+	defer unmarkTusBusy(id)
+
+	if _, _, ok := loadTusUploadFor(w, r, id); !ok {
+		return
+	}
+
+	if err := deleteTusUpload(id); err != nil {
+		DoError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Periodically delete expired uploads. Runs forever, so call this
+// function in its own goroutine.
+func ReapTusUploads() {
+	for {
+		reapTusUploadsOnce()
+		time.Sleep(TUS_REAP_INTERVAL)
+	}
+}
+
+// Check everything that is common to all tus requests. Returns true if
+// we should continue serving the request. If it returns false, an error
+// was already written to w.
+func tusPreamble(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", TUS_VERSION)
+
+	if permitted := ErrorIfNotPermitted(w, r, SCOPE_UPLOAD); !permitted {
+		return false
+	}
+
+	if version := r.Header.Get("Tus-Resumable"); version != TUS_VERSION {
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		DoError(w, r, http.StatusPreconditionFailed, "unsupported Tus-Resumable")
+		return false
+	}
+
+	return true
+}
+
+// Load the upload with given id and make sure it belongs to the user
+// making request r. Returns true if we should continue serving the
+// request. If it returns false, an error was already written to w.
+func loadTusUploadFor(w http.ResponseWriter, r *http.Request, id string) (*TusUpload, int64, bool) {
+	user, err := RequestUser(r)
+	if err != nil {
+		DoError(w, r, http.StatusUnauthorized, err.Error())
+		return nil, 0, false
+	}
+
+	upload, offset, err := loadTusUpload(id)
+	if err != nil {
+		DoError(w, r, StatusForLoadError(err), err.Error())
+		return nil, 0, false
+	}
+
+	if !user.MayResume(upload) {
+		DoError(w, r, http.StatusForbidden, "only the owner of an upload may resume it")
+		return nil, 0, false
+	}
+
+	return upload, offset, true
+}
+
+// Parse the Upload-Metadata header. It contains comma separated key
+// value pairs where the value is base64 encoded.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, `bad value for key="%v" in Upload-Metadata`, fields[0])
+			}
+
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, errors.New("malformed Upload-Metadata")
+		}
+	}
+
+	return metadata, nil
+}
+
+// Return the directory where we keep unfinished uploads.
+func tusDirectory() string {
+	return filepath.Join(GetConfig().StagingDirectory, "tus")
+}
+
+// Return the paths to the files for unfinished upload with given id.
+func tusPathsFor(id string) (infoPath, dataPath string) {
+	base := filepath.Join(tusDirectory(), id)
+	return base + ".json", base + ".bin"
+}
+
+func createTusUpload(upload *TusUpload) error {
+	if err := os.MkdirAll(tusDirectory(), 0700); err != nil {
+		return errors.Wrap(err, "cannot create tus directory")
+	}
+
+	infoPath, dataPath := tusPathsFor(upload.Id)
+
+	infobytes, err := json.Marshal(upload)
+	if err != nil {
+		return errors.Wrapf(err, `cannot construct info for upload id="%v"`, upload.Id)
+	}
+
+	if err := ioutil.WriteFile(dataPath, nil, 0600); err != nil {
+		return errors.Wrapf(err, `cannot create data file for upload id="%v"`, upload.Id)
+	}
+
+	if err := ioutil.WriteFile(infoPath, infobytes, 0600); err != nil {
+		os.Remove(dataPath)
+		return errors.Wrapf(err, `cannot write info for upload id="%v"`, upload.Id)
+	}
+
+	return nil
+}
+
+// Write the info of upload again after it changed. We overwrite the
+// info file in place rather than replacing it, as markTusBusy holds a
+// lock on it.
+func updateTusUpload(upload *TusUpload) error {
+	infoPath, _ := tusPathsFor(upload.Id)
+
+	infobytes, err := json.Marshal(upload)
+	if err != nil {
+		return errors.Wrapf(err, `cannot construct info for upload id="%v"`, upload.Id)
+	}
+
+	err = writeSynced(infoPath, func(w io.Writer) error {
+		_, err := w.Write(infobytes)
+		return err
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, `cannot write info for upload id="%v"`, upload.Id)
+	}
+
+	return nil
+}
+
+// Load the upload with given id. Also returns the number of bytes
+// received so far.
+func loadTusUpload(id string) (*TusUpload, int64, error) {
+	if _, err := ParseUploadId(id); err != nil {
+		return nil, 0, err
+	}
+
+	infoPath, dataPath := tusPathsFor(id)
+
+	infobytes, err := ioutil.ReadFile(infoPath)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, `cannot read info for upload id="%v"`, id)
+	}
+
+	var upload TusUpload
+	if err := json.Unmarshal(infobytes, &upload); err != nil {
+		return nil, 0, errors.Wrapf(err, `cannot parse info for upload id="%v"`, id)
+	}
+
+	if time.Now().UTC().After(upload.ExpiresOnUTC) {
+		return nil, 0, fmt.Errorf(`upload id="%v" expired`, id)
+	}
+
+	if upload.Finished() {
+		return &upload, upload.Length, nil
+	}
+
+	fi, err := os.Stat(dataPath)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, `cannot stat data for upload id="%v"`, id)
+	}
+
+	return &upload, fi.Size(), nil
+}
+
+// Append bytes from src to the data file of upload. offset is the
+// current size of the data file. Returns the new offset. Even if this
+// function returns an error, all bytes we could read from src are
+// kept; the client can resume from there. The exception is src being
+// longer than what is left of the upload, in which case nothing is kept
+// and ErrTusTooLong is returned.
+func appendTusUpload(upload *TusUpload, offset int64, src io.Reader) (int64, error) {
+	_, dataPath := tusPathsFor(upload.Id)
+
+	fd, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return offset, errors.Wrapf(err, `cannot open data for upload id="%v"`, upload.Id)
+	}
+
+	defer fd.Close()
+
+	// we read one byte more than needed to find out whether src is
+	// too long
+
+	start := offset
+
+	remaining := &io.LimitedReader{R: src, N: upload.Length - offset + 1}
+	nbytes, err := io.Copy(fd, remaining)
+	offset += nbytes
+
+	if offset > upload.Length {
+		fd.Close()
+
+		if err := os.Truncate(dataPath, start); err != nil {
+			return offset, errors.Wrapf(err, `cannot truncate data for upload id="%v"`, upload.Id)
+		}
+
+		return start, ErrTusTooLong
+	}
+
+	if err != nil {
+		return offset, errors.Wrapf(err, `cannot write data for upload id="%v"`, upload.Id)
+	}
+
+	if err := fd.Close(); err != nil {
+		return offset, errors.Wrapf(err, `cannot close data for upload id="%v"`, upload.Id)
+	}
+
+	return offset, nil
+}
+
+// Turn a completely received upload into a regular file and record
+// that in the info of upload. Only then the received bytes are deleted,
+// so if anything fails before, calling this function again is safe.
+func finishTusUpload(upload *TusUpload) error {
+	_, dataPath := tusPathsFor(upload.Id)
+
+	fd, err := os.Open(dataPath)
+	if err != nil {
+		return errors.Wrapf(err, `cannot open data for upload id="%v"`, upload.Id)
+	}
+
+	defer fd.Close()
+
+	fm, err := CreateFile(fd, upload.Filename, &upload.Options)
+	if err != nil {
+		return err
+	}
+
+	upload.FileId = fm.Id
+
+	// if we cannot record the file, we would create it again on
+	// the next try, so we rather delete it now
+
+	if err := updateTusUpload(upload); err != nil {
+		upload.FileId = ""
+		discardUploads([]*UploadResult{{File: fm}})
+		return err
+	}
+
+	fd.Close()
+
+	if err := os.Remove(dataPath); err != nil {
+		log.Printf(`could not clean up data of upload id="%v": %v`, upload.Id, err)
+	}
+
+	return nil
+}
+
+func deleteTusUpload(id string) error {
+	if _, err := ParseUploadId(id); err != nil {
+		return err
+	}
+
+	infoPath, dataPath := tusPathsFor(id)
+
+	// finished uploads have no data anymore
+
+	dataErr := os.Remove(dataPath)
+	infoErr := os.Remove(infoPath)
+
+	if infoErr != nil {
+		return infoErr
+	}
+
+	if os.IsNotExist(dataErr) {
+		return nil
+	}
+
+	return dataErr
+}
+
+func reapTusUploadsOnce() {
+	fis, err := ioutil.ReadDir(tusDirectory())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("cannot list tus uploads: %v", err)
+		}
+
+		return
+	}
+
+	for _, fi := range fis {
+		id, ok := cutSuffix(fi.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		if !markTusBusy(id) {
+			continue
+		}
+
+		if _, _, err := loadTusUpload(id); err != nil {
+			log.Printf(`removing upload id="%v": %v`, id, err)
+			deleteTusUpload(id)
+		}
+
+		unmarkTusBusy(id)
+	}
+}
+
+// Like strings.CutSuffix which is not available in Go 1.18.
+func cutSuffix(s, suffix string) (string, bool) {
+	if !strings.HasSuffix(s, suffix) {
+		return s, false
+	}
+
+	return strings.TrimSuffix(s, suffix), true
+}
+
+// Mark upload with given id as busy. Returns false if it already
+// was marked busy, by us or by another process.
+func markTusBusy(id string) bool {
+	tusBusyLock.Lock()
+	defer tusBusyLock.Unlock()
+
+	if _, busy := tusBusy[id]; busy {
+		return false
+	}
+
+	// if the id is bad or there is no info file, there is no upload
+	// to protect; we still mark it busy and let loadTusUpload report
+	// the problem
+
+	fd, err := openTusInfo(id)
+	if err != nil {
+		tusBusy[id] = nil
+		return true
+	}
+
+	locked, err := tryFlockExclusive(fd)
+	if err != nil {
+		log.Printf(`cannot lock upload id="%v": %v`, id, err)
+	}
+
+	if !locked {
+		fd.Close()
+		return false
+	}
+
+	tusBusy[id] = fd
+	return true
+}
+
+func unmarkTusBusy(id string) {
+	tusBusyLock.Lock()
+	defer tusBusyLock.Unlock()
+
+	if fd := tusBusy[id]; fd != nil {
+		funlock(fd)
+		fd.Close()
+	}
+
+	delete(tusBusy, id)
+}
+
+// Open the info file of the upload with given id for locking.
+func openTusInfo(id string) (*os.File, error) {
+	if _, err := ParseUploadId(id); err != nil {
+		return nil, err
+	}
+
+	infoPath, _ := tusPathsFor(id)
+	return os.Open(infoPath)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Uploads with multipart/form-data requests, as sent by /submit and
+// the API. One request can contain any number of files. Parts are
+// read in the order they arrive and files are streamed into storage
+// while they are read, without spooling the request to a temporary
+// file first. That is why options have to be sent before the files
+// they apply to.
+
+// Maximum length of form fields besides files.
+const MAX_FORM_VALUE_LEN = 4096
+
+// Maximum number of files and of other form fields in one request.
+// Each file is limited by MaxFileSize, so together with these limits
+// no request can go on forever.
+const (
+	MAX_UPLOAD_FILES  = 1000
+	MAX_UPLOAD_FIELDS = 100
+)
+
+// Maximum number of collections to put uploaded files into.
+const MAX_UPLOAD_COLLECTIONS = 32
+
+// What happened to one file of an upload.
+type UploadResult struct {
+	// Name of the file as sent by the client, including the path
+	// for files uploaded as part of a folder.
+	Filename string
+
+	// The created file. Nil if creating it failed.
+	File *File
+
+	// Why creating the file failed, nil if it succeeded.
+	Err error
+
+	// HTTP status code that describes Err, e.g. 400 for bad file
+	// names. Zero if creating the file succeeded.
+	Status int
+}
+
+// Read all files in multipart form field "file" of r and store them
+// with CreateFile. Other form fields set options for the files that
+// follow them.
+//
+// Returns what happened to each file. Files can fail individually,
+// e.g. if a thumbnail cannot be created. If the request as a whole is
+// broken, e.g. because one of the files is larger than MaxFileSize,
+// returns an error and the HTTP status code that should be reported
+// to the client; files already created by the request are deleted
+// again in that case.
+func ReceiveUploads(w http.ResponseWriter, r *http.Request) ([]*UploadResult, int, error) {
+	user, err := RequestUser(r)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	form := uploadForm{opts: CreateOptions{Owner: user.Name}}
+
+	results, status, err := form.receive(mr)
+	if err != nil {
+		discardUploads(results)
+		return nil, status, err
+	}
+
+	if len(results) == 0 {
+		return nil, http.StatusBadRequest, errors.New("missing file")
+	}
+
+	return results, http.StatusCreated, nil
+}
+
+// State of parsing one multipart upload request.
+type uploadForm struct {
+	// Options for creating the files, filled in from the form fields.
+	opts CreateOptions
+
+	// Names of collections to put the files into and whether to
+	// create them if they do not exist.
+	collections      []string
+	createCollection bool
+}
+
+// Read all parts of mr. Returns the results for all files read so
+// far, even on error.
+func (uf *uploadForm) receive(mr *multipart.Reader) ([]*UploadResult, int, error) {
+	var (
+		results []*UploadResult
+		fields  int
+	)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return results, http.StatusCreated, nil
+		}
+
+		if err != nil {
+			return results, http.StatusBadRequest, err
+		}
+
+		filename := rawFileName(part)
+
+		switch {
+		case part.FormName() == "file" && filename != "":
+			if len(results) == MAX_UPLOAD_FILES {
+				return results, http.StatusRequestEntityTooLarge, fmt.Errorf("cannot upload more than %v files at once", MAX_UPLOAD_FILES)
+			}
+
+			if len(results) == 0 {
+				if err := prepareUploadCollections(uf.collections, uf.createCollection); err != nil {
+					return results, http.StatusBadRequest, err
+				}
+
+				uf.opts.Collections = uf.collections
+				uf.opts.CreateCollections = uf.createCollection
+			}
+
+			result, err := uf.receiveFile(part, filename)
+			if result != nil {
+				results = append(results, result)
+			}
+
+			if err != nil {
+				return results, http.StatusRequestEntityTooLarge, err
+			}
+
+		case fields == MAX_UPLOAD_FIELDS:
+			return results, http.StatusRequestEntityTooLarge, fmt.Errorf("cannot send more than %v form fields", MAX_UPLOAD_FIELDS)
+
+		case part.FormName() == "file":
+			// browsers send file inputs without a selected file as
+			// parts without a file name; we skip these, but count
+			// them so requests cannot go on forever
+
+			fields += 1
+
+		case len(results) > 0:
+			return results, http.StatusBadRequest, fmt.Errorf(`form field="%v" must come before the files`, part.FormName())
+
+		default:
+			fields += 1
+
+			if status, err := uf.receiveField(part); err != nil {
+				return results, status, err
+			}
+		}
+	}
+}
+
+// Store the file in part, which the client named filename. Returns
+// an error if the file is larger than MaxFileSize. We stop reading
+// such files, so the rest of the request is lost as well.
+func (uf *uploadForm) receiveFile(part *multipart.Part, filename string) (*UploadResult, error) {
+	result := UploadResult{Filename: filename}
+
+	name, relPath := parseUploadPath(filename)
+	if name == "" {
+		result.Err = fmt.Errorf(`bad filename="%v"`, filename)
+		result.Status = http.StatusBadRequest
+		return &result, nil
+	}
+
+	opts := uf.opts
+	opts.Path = relPath
+
+	src := &sizeLimitedReader{r: part, left: GetConfig().MaxFileSize}
+
+	result.File, result.Err = CreateFile(src, name, &opts)
+
+	if src.exceeded {
+		return nil, fmt.Errorf(`filename="%v" exceeds MaxFileSize=%v bytes`, filename, GetConfig().MaxFileSize)
+	}
+
+	if result.Err != nil {
+		result.Status = http.StatusInternalServerError
+	}
+
+	return &result, nil
+}
+
+// Return the status code to report if some of results failed. That is
+// the highest status of the failed files, so errors on our side win
+// over errors of the client. Returns zero if no file failed.
+func failedUploadStatus(results []*UploadResult) int {
+	var status int
+
+	for _, result := range results {
+		if result.Err != nil && result.Status > status {
+			status = result.Status
+		}
+	}
+
+	return status
+}
+
+// Apply the form field in part to the options.
+func (uf *uploadForm) receiveField(part *multipart.Part) (int, error) {
+	bs, err := ioutil.ReadAll(io.LimitReader(part, MAX_FORM_VALUE_LEN+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if len(bs) > MAX_FORM_VALUE_LEN {
+		return http.StatusBadRequest, fmt.Errorf(`form field="%v" too long`, part.FormName())
+	}
+
+	value := string(bs)
+
+	switch part.FormName() {
+	case "create_short_id":
+		uf.opts.CreateShortId = value == "true"
+
+	case "lifetime":
+		if uf.opts.Lifetime, err = parseLifetime(value); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+	case "max_downloads":
+		if uf.opts.MaxDownloads, err = parseMaxDownloads(value); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+	case "password":
+		if uf.opts.PassHash, err = parsePassword(value); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+	case "collection":
+		names, err := parseCollections([]string{value})
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		uf.collections = append(uf.collections, names...)
+
+	case "create_collection":
+		uf.createCollection = value == "true"
+	}
+
+	return http.StatusOK, nil
+}
+
+// Delete the files created for results. Used for rolling back requests
+// that failed halfway.
+func discardUploads(results []*UploadResult) {
+	lease := LockWrite()
+	defer lease.Unlock()
+
+	for _, result := range results {
+		if result.File == nil {
+			continue
+		}
+
+		if err := DeleteFile(result.File.Id); err != nil {
+			log.Printf(`could not delete id="%v" of failed upload: %v`, result.File.Id, err)
+		}
+	}
+}
+
+// Check that collections exist, so clients learn about typos before
+// they upload a whole file. If create is true, collections that do
+// not exist yet are fine; CreateFile creates them with the first file
+// stored in them.
+func prepareUploadCollections(collections []string, create bool) error {
+	if len(collections) == 0 {
+		return nil
+	}
+
+	if len(collections) > MAX_UPLOAD_COLLECTIONS {
+		return fmt.Errorf("cannot put files into more than %v collections", MAX_UPLOAD_COLLECTIONS)
+	}
+
+	if create {
+		return nil
+	}
+
+	lease := LockRead()
+	defer lease.Unlock()
+
+	return checkCollections(collections)
+}
+
+// Return the file name of part exactly as the client sent it.
+// part.FileName only returns the last element, but for files uploaded
+// as part of a folder we want the path as well.
+func rawFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
+
+// Split a file name sent by a client into the name of the file and,
+// for files that are part of a folder, the path of the file relative
+// to that folder, e.g. "docs/intro.md" into "intro.md" and
+// "docs/intro.md". For files not in a folder, relPath is empty.
+// Elements like "." and ".." are dropped, so the path never leaves
+// the folder.
+func parseUploadPath(filename string) (name, relPath string) {
+	var elems []string
+
+	for _, elem := range strings.Split(strings.ReplaceAll(filename, "\\", "/"), "/") {
+		if elem != "" && elem != "." && elem != ".." {
+			elems = append(elems, elem)
+		}
+	}
+
+	if len(elems) == 0 {
+		return "", ""
+	}
+
+	name = elems[len(elems)-1]
+
+	if len(elems) > 1 {
+		relPath = strings.Join(elems, "/")
+	}
+
+	return name, relPath
+}
+
+// Reader that fails once more than left bytes are read from it.
+type sizeLimitedReader struct {
+	r        io.Reader
+	left     int64
+	exceeded bool
+}
+
+func (sl *sizeLimitedReader) Read(p []byte) (int, error) {
+	if sl.exceeded {
+		return 0, errors.New("file too large")
+	}
+
+	// read one byte more than allowed, so we notice files that are
+	// exactly one byte too large
+
+	if int64(len(p)) > sl.left+1 {
+		p = p[:sl.left+1]
+	}
+
+	n, err := sl.r.Read(p)
+
+	if int64(n) > sl.left {
+		sl.exceeded = true
+		return int(sl.left), errors.New("file too large")
+	}
+
+	sl.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a user can have.
+const (
+	// Users may upload files and delete files they uploaded
+	// themselves.
+	ROLE_USER = "user"
+
+	// Admins may additionally delete files uploaded by others.
+	ROLE_ADMIN = "admin"
+)
+
+// A user account as set up in the configuration file.
+type User struct {
+	// Name the user logs in with. Also recorded as owner of
+	// uploaded files.
+	Name string
+
+	// Bcrypt hash of the password of this user. See Config.PassHashes
+	// on how to generate one.
+	PassHash string
+
+	// Either "user" or "admin". If left empty, "user" is used.
+	Role string
+}
+
+// Return whether this user is an admin.
+func (u *User) IsAdmin() bool {
+	return u.Role == ROLE_ADMIN
+}
+
+// Return whether this user may delete file fm.
+func (u *User) MayDelete(fm *File) bool {
+	return u.IsAdmin() || fm.Owner == u.Name
+}
+
+// Return whether this user may change file fm, e.g. put it into
+// collections.
+func (u *User) MayChange(fm *File) bool {
+	return u.IsAdmin() || fm.Owner == u.Name
+}
+
+// Return whether this user may continue, inspect and cancel the
+// unfinished tus upload.
+func (u *User) MayResume(upload *TusUpload) bool {
+	return u.IsAdmin() || upload.Options.Owner == u.Name
+}
+
+// Return whether this user may share and delete collection c.
+func (u *User) MayManageCollection(c *Collection) bool {
+	return u.IsAdmin() || c.Owner == u.Name
+}
+
+// Return whether this user may see and revoke token t.
+func (u *User) MayManage(t *ApiToken) bool {
+	return u.IsAdmin() || t.Owner == u.Name
+}
+
+// Return any errors in the definition of this user.
+func (u *User) Error() error {
+	if u.Name == "" {
+		return errors.New("empty user Name")
+	}
+
+	if u.PassHash == "" {
+		return fmt.Errorf(`empty PassHash for user="%v"`, u.Name)
+	}
+
+	switch u.Role {
+	case "", ROLE_USER, ROLE_ADMIN:
+		return nil
+	default:
+		return fmt.Errorf(`unknown Role="%v" for user="%v"`, u.Role, u.Name)
+	}
+}
+
+// The user we use for passwords in Config.PassHashes. These passwords
+// predate user accounts, so they get an empty name and, as they were
+// always allowed to do everything, the admin role.
+var legacyUser = User{Name: "", Role: ROLE_ADMIN}
+
+// Return the user with given name. Returns an error if there is no
+// such user.
+func FindUser(name string) (*User, error) {
+	if name == "" {
+		if len(GetConfig().PassHashes) == 0 {
+			return nil, errors.New("no legacy passwords configured")
+		}
+
+		return &legacyUser, nil
+	}
+
+	for i := range GetConfig().Users {
+		if u := &GetConfig().Users[i]; u.Name == name {
+			return u, nil
+		}
+	}
+
+	return nil, fmt.Errorf(`no user="%v"`, name)
+}
+
+// Return the user with given name and password. Returns false if the
+// user does not exist or the password is wrong. An empty name checks
+// pass against the legacy Config.PassHashes.
+func Authenticate(name, pass string) (*User, bool) {
+	if name == "" {
+		if !IsValidPassword(pass) {
+			return nil, false
+		}
+
+		return &legacyUser, true
+	}
+
+	u, err := FindUser(name)
+	if err != nil {
+		return nil, false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PassHash), []byte(pass)); err != nil {
+		return nil, false
+	}
+
+	return u, true
+}
+
+// Return the user request r acts on behalf of. For requests with an
+// API token, this is the user who created the token. Otherwise it is
+// the user who is logged in.
+func RequestUser(r *http.Request) (*User, error) {
+	if token, ok := BearerToken(r); ok {
+		t, err := LookupToken(token)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not authorize token")
+		}
+
+		return FindUser(t.Owner)
+	}
+
+	ac, err := authorizedCookieOf(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ac.Authorized() {
+		return nil, errors.New("not logged in")
+	}
+
+	return FindUser(ac.Username)
+}